@@ -0,0 +1,122 @@
+// Command explore tabulates the parameters and predicted costs of GulliverPIR
+// over a grid of settings, as CSV or JSON.
+//
+// Every range flag takes a comma-separated list of values or lo:hi[:step],
+// for example
+//
+//	explore -n 1024,2048 -logd 16:24:4 -record 8,256 -time
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/llllinyl/gulliverpir/tree/main/gulliverpir-main/pir"
+)
+
+func main() {
+	n := flag.String("n", "1024", "secret dimensions")
+	logD := flag.String("logd", "20", "log2 of the number of records")
+	record := flag.String("record", "8", "record sizes in bits")
+	logQ := flag.String("logQ", "32", "log2 of the hint modulus")
+	logq := flag.String("logq", "28", "log2 of the query modulus")
+	offline := flag.Float64("w-offline", 1, "weight of the hint size when planning")
+	upload := flag.Float64("w-upload", 1, "weight of the query size when planning")
+	download := flag.Float64("w-download", 1, "weight of the answer size when planning")
+	format := flag.String("format", "csv", "output format: csv or json")
+	timed := flag.Bool("time", false, "measure Setup and Answer on random databases")
+	verbose := flag.Bool("v", false, "log the progress of the library to stderr")
+	flag.Parse()
+
+	if *verbose {
+		pir.SetLogOutput(os.Stderr)
+	} else {
+		pir.SetLogOutput(nil)
+	}
+
+	g := pir.ExploreGrid{
+		Weights: pir.CostWeights{Offline: *offline, Upload: *upload, Download: *download},
+		Time:    *timed,
+	}
+	for _, r := range []struct {
+		flag string
+		dst  *[]uint64
+	}{{*n, &g.N}, {*logD, &g.LogD}, {*record, &g.RecordBits}, {*logQ, &g.LogQ}, {*logq, &g.Logq}} {
+		vals, err := parseRange(r.flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		*r.dst = vals
+	}
+	if *format != "csv" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		os.Exit(2)
+	}
+
+	rows := pir.Explore(g)
+
+	var err error
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	} else {
+		w := csv.NewWriter(os.Stdout)
+		w.Write(pir.ExploreHeader())
+		for i := range rows {
+			w.Write(rows[i].Record())
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// parseRange parses a comma-separated list of values or lo:hi[:step].
+func parseRange(s string) ([]uint64, error) {
+	if parts := strings.Split(s, ":"); len(parts) > 1 {
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		bounds := make([]uint64, 3)
+		bounds[2] = 1
+		for i, part := range parts {
+			v, err := strconv.ParseUint(part, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %v", s, err)
+			}
+			bounds[i] = v
+		}
+		if bounds[2] == 0 || bounds[0] > bounds[1] {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		var vals []uint64
+		for v := bounds[0]; ; v += bounds[2] {
+			vals = append(vals, v)
+			if bounds[1]-v < bounds[2] {
+				// The next step would pass hi, or wrap around.
+				break
+			}
+		}
+		return vals, nil
+	}
+
+	var vals []uint64
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q: %v", part, err)
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
@@ -0,0 +1,186 @@
+package pir
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// DBBuilder builds a database one record at a time, writing every record
+// straight into its packed or expanded position in the database matrix, so
+// the records never have to be held in memory all at once. Records are
+// added in index order; Finish returns the database once all Num records
+// have been added.
+type DBBuilder struct {
+	db *Database
+	i  uint64 // number of records added
+
+	cur, coeff uint64 // Z_p element being packed, and the weight of the next record
+	done       bool
+}
+
+// NewDBBuilder validates p for Num records of row_length bits each and
+// allocates the database matrix.
+func NewDBBuilder(Num, row_length uint64, p *Params) (*DBBuilder, error) {
+	D, err := NewDatabase(Num, row_length, p)
+	if err != nil {
+		return nil, err
+	}
+	D.Data = MatrixNewWidth(p.L, p.M, p.wide())
+	return &DBBuilder{db: D}, nil
+}
+
+// Added returns the number of records added so far.
+func (b *DBBuilder) Added() uint64 {
+	return b.i
+}
+
+// check ensures that another record can be added.
+func (b *DBBuilder) check() error {
+	if b.done {
+		return fmt.Errorf("%w: database is already finished", ErrInvalidParams)
+	}
+	if b.i >= b.db.Info.Num {
+		return fmt.Errorf("%w: database holds only %d records", ErrIndexOutOfRange, b.db.Info.Num)
+	}
+	return nil
+}
+
+// Add adds the next record, of at most Row_length bits.
+func (b *DBBuilder) Add(val uint64) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	info := &b.db.Info
+	if info.Row_length < 64 && val >= 1<<info.Row_length {
+		return fmt.Errorf("%w: record %d has value %d, which does not fit in %d bits",
+			ErrInvalidParams, b.i, val, info.Row_length)
+	}
+	if info.Packing > 0 {
+		b.pack(val)
+		return nil
+	}
+	m := b.db.Data.Cols
+	for j := uint64(0); j < info.Ne; j++ {
+		b.db.Data.Set(Base_p(info.P, val, j), (b.i/m)*info.Ne+j, b.i%m)
+	}
+	b.i++
+	return nil
+}
+
+// AddBytes adds the next record as a big-endian integer of at most
+// Row_length bits, which may be much wider than 64 bits.
+func (b *DBBuilder) AddBytes(rec []byte) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	info := &b.db.Info
+	if new(big.Int).SetBytes(rec).BitLen() > int(info.Row_length) {
+		return fmt.Errorf("%w: record %d does not fit in %d bits", ErrInvalidParams, b.i, info.Row_length)
+	}
+	if info.Packing > 0 {
+		var v uint64
+		for _, c := range rec {
+			v = v<<8 | uint64(c)
+		}
+		b.pack(v)
+		return nil
+	}
+	m := b.db.Data.Cols
+	for j, digit := range bytesToBaseP(rec, info.P, info.Ne) {
+		b.db.Data.Set(digit, (b.i/m)*info.Ne+uint64(j), b.i%m)
+	}
+	b.i++
+	return nil
+}
+
+// AddAll adds the records produced by next until it reports that there are
+// no more.
+func (b *DBBuilder) AddAll(next func() (uint64, bool)) error {
+	for {
+		val, ok := next()
+		if !ok {
+			return nil
+		}
+		if err := b.Add(val); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadFrom adds the records read from r until EOF, as big-endian integers of
+// ceil(Row_length/8) bytes each. It implements io.ReaderFrom.
+func (b *DBBuilder) ReadFrom(r io.Reader) (int64, error) {
+	rec := make([]byte, (b.db.Info.Row_length+7)/8)
+	br := bufio.NewReader(r)
+	var n int64
+	for {
+		k, err := io.ReadFull(br, rec)
+		n += int64(k)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("%w: truncated record: %v", ErrMalformedRecords, err)
+		}
+		if err := b.AddBytes(rec); err != nil {
+			return n, err
+		}
+	}
+}
+
+// pack adds the next record to the Z_p element being packed, and stores the
+// element once it is full.
+func (b *DBBuilder) pack(val uint64) {
+	info := &b.db.Info
+	if b.i%info.Packing == 0 {
+		b.cur, b.coeff = 0, 1
+	}
+	b.cur += val * b.coeff
+	b.coeff <<= info.Row_length
+	b.i++
+	if b.i%info.Packing == 0 {
+		b.flush()
+	}
+}
+
+// flush stores the Z_p element packed so far.
+func (b *DBBuilder) flush() {
+	m := b.db.Data.Cols
+	at := (b.i - 1) / b.db.Info.Packing
+	b.db.Data.Set(b.cur, at/m, at%m)
+}
+
+// Finish stores a partially packed last element, centres the entries and
+// returns the database. It fails unless exactly Num records were added.
+func (b *DBBuilder) Finish() (*Database, error) {
+	if b.done {
+		return nil, fmt.Errorf("%w: database is already finished", ErrInvalidParams)
+	}
+	if b.i != b.db.Info.Num {
+		return nil, fmt.Errorf("%w: got %d records for %d entries", ErrInvalidParams, b.i, b.db.Info.Num)
+	}
+	if b.db.Info.Packing > 0 && b.i%b.db.Info.Packing != 0 {
+		b.flush()
+	}
+	b.db.Data.Sub(b.db.Info.P / 2)
+	b.done = true
+	return b.db, nil
+}
+
+// FinishReserved is like Finish, but accepts fewer than Num records. The
+// remaining entries are zero and reserved: a Server set up from the
+// database fills them with Append, without changing the parameters, the
+// shared state or the hint clients hold.
+func (b *DBBuilder) FinishReserved() (*Database, error) {
+	if b.done {
+		return nil, fmt.Errorf("%w: database is already finished", ErrInvalidParams)
+	}
+	if b.db.Info.Packing > 0 && b.i%b.db.Info.Packing != 0 {
+		b.flush()
+	}
+	b.db.free = b.db.Info.Num - b.i
+	b.db.Data.Sub(b.db.Info.P / 2)
+	b.done = true
+	return b.db, nil
+}
@@ -0,0 +1,222 @@
+package pir
+
+import (
+	"fmt"
+	"sync"
+)
+
+// QueryHandle identifies a query issued by a Client until it is recovered.
+type QueryHandle uint64
+
+type pendingQuery struct {
+	index uint64
+	state State
+	query Msg
+}
+
+// Client is the stateful client side of a PIR scheme. It owns the public
+// parameters, the shared state rebuilt from their seed, the hint, and the
+// secrets of all queries that have not been recovered yet. A Client is safe
+// for concurrent use.
+type Client struct {
+	pi     PIR
+	params PublicParams
+	shared State
+
+	hintMu sync.RWMutex // guards hint against ApplyPatch
+	hint   Msg
+
+	mu      sync.Mutex
+	next    QueryHandle
+	pending map[QueryHandle]pendingQuery
+	pool    []State // precomputed query material, see Preprocess
+}
+
+// NewClient builds a client for scheme pi from the public parameters and the
+// hint published by a Server.
+func NewClient(pi PIR, params []byte, hint []byte) (*Client, error) {
+	c := &Client{pi: pi, pending: make(map[QueryHandle]pendingQuery)}
+	if err := c.params.UnmarshalBinary(params); err != nil {
+		return nil, err
+	}
+	if c.params.Scheme != pi.Name() {
+		return nil, fmt.Errorf("%w: parameters are for %s, not %s", ErrInvalidParams, c.params.Scheme, pi.Name())
+	}
+	if err := c.hint.UnmarshalBinary(hint); err != nil {
+		return nil, err
+	}
+	c.shared = pi.DecompressState(c.params.Info, c.params.Params, MakeCompressedState(&c.params.Seed))
+	return c, nil
+}
+
+// NumRecords returns the number of records in the database, including the
+// slots a server reserves for Append, which read as zero until filled.
+func (c *Client) NumRecords() uint64 {
+	return c.params.Info.Num
+}
+
+// Preprocess precomputes the index-independent material of n queries, if the
+// scheme supports it. Later calls to Query consume this material first, which
+// leaves them little more than adding a unit vector.
+func (c *Client) Preprocess(n int) error {
+	pi, ok := c.pi.(PreprocessingPIR)
+	if !ok {
+		return fmt.Errorf("%w: %s does not support query precomputation", ErrInvalidParams, c.pi.Name())
+	}
+	for j := 0; j < n; j++ {
+		// Hold the hint until the material is pooled, so that ApplyPatch
+		// cannot miss it.
+		c.hintMu.RLock()
+		pre, err := pi.Precompute(c.hint, c.shared, c.params.Params, c.params.Info)
+		if err != nil {
+			c.hintMu.RUnlock()
+			return err
+		}
+		c.mu.Lock()
+		c.pool = append(c.pool, pre)
+		c.mu.Unlock()
+		c.hintMu.RUnlock()
+	}
+	return nil
+}
+
+// Precomputed returns the number of queries whose material is ready.
+func (c *Client) Precomputed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pool)
+}
+
+// Query builds an encoded query for record index. The returned handle must
+// be passed to Recover together with the server's answer.
+func (c *Client) Query(index uint64) (QueryHandle, []byte, error) {
+	if index >= c.params.Info.Num {
+		return 0, nil, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, index, c.params.Info.Num)
+	}
+	var state State
+	var query Msg
+	var err error
+	if pre, ok := c.popPrecomputed(); ok {
+		state, query, err = c.pi.(PreprocessingPIR).QueryPrecomputed(index, pre, c.params.Params, c.params.Info)
+	} else {
+		state, query, err = c.pi.Query(index, c.shared, c.params.Params, c.params.Info)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	enc, err := query.MarshalBinary()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.next
+	c.next++
+	c.pending[h] = pendingQuery{index: index, state: state, query: query}
+	return h, enc, nil
+}
+
+// popPrecomputed removes one entry from the pool of precomputed material.
+// Material is never reused, since that would reuse the secret.
+func (c *Client) popPrecomputed() (State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pool) == 0 {
+		return State{}, false
+	}
+	pre := c.pool[len(c.pool)-1]
+	c.pool = c.pool[:len(c.pool)-1]
+	return pre, true
+}
+
+// Recover decodes the server's answer to the query identified by h. The
+// handle is released, whether or not decoding succeeds.
+func (c *Client) Recover(h QueryHandle, answer []byte) (uint64, error) {
+	pq, ans, err := c.takePending(h, answer)
+	if err != nil {
+		return 0, err
+	}
+	c.hintMu.RLock()
+	defer c.hintMu.RUnlock()
+	return c.pi.Recover(pq.index, 0, c.hint, pq.query, ans, c.shared, pq.state, c.params.Params, c.params.Info)
+}
+
+// RecoverBytes is like Recover for databases built by NewDatabaseFromBytes.
+func (c *Client) RecoverBytes(h QueryHandle, answer []byte) ([]byte, error) {
+	pq, ans, err := c.takePending(h, answer)
+	if err != nil {
+		return nil, err
+	}
+	c.hintMu.RLock()
+	defer c.hintMu.RUnlock()
+	return c.pi.RecoverBytes(pq.index, 0, c.hint, pq.query, ans, c.shared, pq.state, c.params.Params, c.params.Info)
+}
+
+// RecoverColumn is like Recover, but returns every entry stored in the same
+// database column as the queried one, if the scheme supports it. It returns
+// the indices of these entries and their values.
+func (c *Client) RecoverColumn(h QueryHandle, answer []byte) ([]uint64, []uint64, error) {
+	pi, ok := c.pi.(ColumnPIR)
+	if !ok {
+		c.Cancel(h)
+		return nil, nil, fmt.Errorf("%w: %s does not support column recovery", ErrInvalidParams, c.pi.Name())
+	}
+	pq, ans, err := c.takePending(h, answer)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.hintMu.RLock()
+	vals, err := pi.RecoverColumn(pq.index, c.hint, pq.query, ans, c.shared, pq.state, c.params.Params, c.params.Info)
+	c.hintMu.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, col := c.params.Info.entryPosition(pq.index, c.params.Params.M)
+	return ColumnIndices(col, c.params.Params, c.params.Info), vals, nil
+}
+
+// takePending releases handle h and decodes the answer to its query.
+func (c *Client) takePending(h QueryHandle, answer []byte) (pendingQuery, Msg, error) {
+	c.mu.Lock()
+	pq, ok := c.pending[h]
+	delete(c.pending, h)
+	c.mu.Unlock()
+	if !ok {
+		return pendingQuery{}, Msg{}, fmt.Errorf("%w: unknown query handle %d", ErrMalformedMsg, h)
+	}
+
+	var ans Msg
+	if err := ans.UnmarshalBinary(answer); err != nil {
+		return pendingQuery{}, Msg{}, err
+	}
+	return pq, ans, nil
+}
+
+// Cancel releases the query identified by h without recovering it.
+func (c *Client) Cancel(h QueryHandle) {
+	c.mu.Lock()
+	delete(c.pending, h)
+	c.mu.Unlock()
+}
+
+// ApplyPatch applies an encoded patch returned by Server.Update to the hint,
+// so that the client can decode the updated records without downloading the
+// hint again. Precomputed query material includes the old hint and is
+// discarded. Queries pending while the patch is applied decode the updated
+// records with whichever hint they see, so apply patches between queries.
+func (c *Client) ApplyPatch(patch []byte) error {
+	var h HintPatch
+	if err := h.UnmarshalBinary(patch); err != nil {
+		return err
+	}
+	c.hintMu.Lock()
+	defer c.hintMu.Unlock()
+	if err := h.Apply(c.hint, c.shared); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pool = nil
+	c.mu.Unlock()
+	return nil
+}
@@ -3,6 +3,8 @@ package pir
 import (
 	"fmt"
 	"math"
+	"math/big"
+	"sync"
 )
 
 // DBinfo stores metadata about the database structure and parameters.
@@ -21,34 +23,111 @@ type DBinfo struct {
 	Basis     uint64
 	Squishing uint64
 	Cols      uint64
+
+	ElemBits uint64 // Width of the matrix entries, see Params.ElemBits.
 }
 
 type Database struct {
 	Info DBinfo
 	Data *Matrix
+
+	free uint64 // zeroed entries at the end, reserved for Server.Append
 }
 
-func (DB *Database) Squish() {
-	DB.Info.Basis = 10
-	DB.Info.Squishing = 3
-	DB.Info.Cols = DB.Data.Cols
-	DB.Data.Squish(DB.Info.Basis, DB.Info.Squishing)
+// Len returns the number of records in use. It is Info.Num unless the
+// database was built with room to grow, see DBBuilder.FinishReserved.
+func (DB *Database) Len() uint64 {
+	return DB.Info.Num - DB.free
+}
+
+// ServerDB is the preprocessed form of a Database that the server answers
+// queries from. It holds the squished matrix and its DBinfo, and is safe for
+// concurrent use by multiple goroutines. Entries can be changed in place with
+// Update.
+type ServerDB struct {
+	info DBinfo
+	data *Matrix
+	hint *ServerDB // second-level database built from the hint, if any
+
+	mu sync.RWMutex // guards data against Update
+}
+
+// Compression settings hard-coded in the packed kernels of pir.c, for 32-bit
+// and 64-bit elements.
+const (
+	squishBasis       = 10
+	squishBasis64     = 20
+	squishCompression = 3
+)
 
-	// Ensure the parameters are suitable for compression.
-	if DB.Info.P > (1<<DB.Info.Basis) || DB.Info.Logq < DB.Info.Basis*DB.Info.Squishing {
-		panic("Invalid parameters for compression")
+// squishSettings returns the basis and compression of the packed kernels for
+// the given element width.
+func squishSettings(wide bool) (uint64, uint64) {
+	if wide {
+		return squishBasis64, squishCompression
 	}
+	return squishBasis, squishCompression
+}
+
+// setSquishParams records the compression settings in info, after ensuring
+// that they are suitable for its parameters.
+func (info *DBinfo) setSquishParams(cols uint64) error {
+	basis, compression := squishSettings(info.ElemBits == 64)
+	width := info.ElemBits
+	if width == 0 {
+		width = elemBits
+	}
+	if info.P > (1<<basis) || width < basis*compression {
+		return fmt.Errorf("%w: p=%d and %d-bit elements do not support compression with basis %d",
+			ErrInvalidParams, info.P, width, basis)
+	}
+	info.Basis = basis
+	info.Squishing = compression
+	info.Cols = cols
+	return nil
+}
+
+// Squish compresses the database in place for the packed kernels. The
+// database is left untouched if its parameters do not support compression.
+func (DB *Database) Squish() error {
+	if err := DB.Info.setSquishParams(DB.Data.Cols); err != nil {
+		return err
+	}
+	DB.Data.Squish(DB.Info.Basis, DB.Info.Squishing)
+	return nil
 }
 
 func (DB *Database) Unsquish() {
 	DB.Data.Unsquish(DB.Info.Basis, DB.Info.Squishing, DB.Info.Cols)
 }
 
+// NewServerDB maps the entries of DB from [-p/2, p/2) to [0, p) and squishes
+// them into a new ServerDB. DB itself is not modified.
+func NewServerDB(DB *Database) (*ServerDB, error) {
+	if DB.Data == nil {
+		return nil, fmt.Errorf("%w: database has no contents", ErrInvalidParams)
+	}
+	server := &ServerDB{info: DB.Info}
+	if err := server.info.setSquishParams(DB.Data.Cols); err != nil {
+		return nil, err
+	}
+	server.data = DB.Data.RowsDeepCopy(0, DB.Data.Rows)
+	server.data.Add(DB.Info.P / 2)
+	server.data.Squish(server.info.Basis, server.info.Squishing)
+	reserveSpareRows(server.data)
+	return server, nil
+}
+
+// Info returns the metadata of the preprocessed database, including its
+// compression settings. Clients need it to build queries.
+func (s *ServerDB) Info() DBinfo {
+	return s.info
+}
+
 // ReconstructElem reconstructs an element from its Z_p representation.
 func ReconstructElem(vals []uint64, index uint64, info DBinfo) uint64 {
-	q := uint64(1 << info.Logq)
 	for i, v := range vals {
-		vals[i] = ((v + info.P/2) % q) % info.P
+		vals[i] = lowBits(v+info.P/2, info.Logq) % info.P
 	}
 	val := Reconstruct_from_base_p(info.P, vals)
 
@@ -58,19 +137,86 @@ func ReconstructElem(vals []uint64, index uint64, info DBinfo) uint64 {
 	return val
 }
 
+// ReconstructBytes reconstructs a byte-string entry from its Z_p
+// representation. The entry is returned as ceil(Row_length/8) big-endian bytes.
+func ReconstructBytes(vals []uint64, index uint64, info DBinfo) []byte {
+	out := make([]byte, (info.Row_length+7)/8)
+	if info.Packing > 0 {
+		val := ReconstructElem(vals, index, info)
+		for j := len(out) - 1; j >= 0; j-- {
+			out[j] = byte(val)
+			val >>= 8
+		}
+		return out
+	}
+
+	p := new(big.Int).SetUint64(info.P)
+	val := new(big.Int)
+	for j := len(vals) - 1; j >= 0; j-- {
+		val.Mul(val, p)
+		val.Add(val, new(big.Int).SetUint64(lowBits(vals[j]+info.P/2, info.Logq)%info.P))
+	}
+
+	// A wrong decoding may not fit; keep the low-order bytes, as uint64
+	// entries do.
+	b := val.Bytes()
+	if len(b) > len(out) {
+		b = b[len(b)-len(out):]
+	}
+	copy(out[len(out)-len(b):], b)
+	return out
+}
+
+// bytesToBaseP returns the ne base-p digits of the big-endian integer rec,
+// least significant first.
+func bytesToBaseP(rec []byte, p, ne uint64) []uint64 {
+	val := new(big.Int).SetBytes(rec)
+	mod := new(big.Int).SetUint64(p)
+	digit := new(big.Int)
+	out := make([]uint64, ne)
+	for j := range out {
+		val.QuoRem(val, mod, digit)
+		out[j] = digit.Uint64()
+	}
+	return out
+}
+
+// entryPosition returns the row group and the column that hold entry i in a
+// database with m columns. Row group r spans rows r*Ne, ..., (r+1)*Ne-1.
+func (info *DBinfo) entryPosition(i, m uint64) (uint64, uint64) {
+	if info.Packing > 0 {
+		i /= info.Packing
+	}
+	return i / m, i % m
+}
+
+// ColumnIndices returns the indices of all entries stored in column col, in
+// the order in which RecoverColumn returns their values.
+func ColumnIndices(col uint64, p Params, info DBinfo) []uint64 {
+	var indices []uint64
+	for r := uint64(0); r < p.L/info.Ne; r++ {
+		elem := r*p.M + col
+		if info.Packing == 0 {
+			if elem < info.Num {
+				indices = append(indices, elem)
+			}
+			continue
+		}
+		for k := uint64(0); k < info.Packing; k++ {
+			if elem*info.Packing+k < info.Num {
+				indices = append(indices, elem*info.Packing+k)
+			}
+		}
+	}
+	return indices
+}
+
 // GetElem retrieves an element from the database by its index.
 func (DB *Database) GetElem(i uint64) uint64 {
 	if i >= DB.Info.Num {
-		panic("Index out of range")
-	}
-	col := i % DB.Data.Cols
-	row := i / DB.Data.Cols
-
-	if DB.Info.Packing > 0 {
-		newI := i / DB.Info.Packing
-		col = newI % DB.Data.Cols
-		row = newI / DB.Data.Cols
+		panic(fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, DB.Info.Num))
 	}
+	row, col := DB.Info.entryPosition(i, DB.Data.Cols)
 
 	var vals []uint64
 	for j := row * DB.Info.Ne; j < (row+1)*DB.Info.Ne; j++ {
@@ -79,18 +225,20 @@ func (DB *Database) GetElem(i uint64) uint64 {
 	return ReconstructElem(vals, i, DB.Info)
 }
 
-// SetupDB initializes a new database with the given parameters.
-func SetupDB(Num, row_length uint64, p *Params) *Database {
-	if Num == 0 || row_length == 0 {
-		panic("Empty database")
+// NewDatabase initializes a new database with the given parameters,
+// without allocating its contents.
+func NewDatabase(Num, row_length uint64, p *Params) (*Database, error) {
+	if err := p.Validate(row_length, Num); err != nil {
+		return nil, err
 	}
 	D := new(Database)
 	D.Info.Num = Num
 	D.Info.Row_length = row_length
 	D.Info.P = p.P
 	D.Info.Logq = p.LogQ
+	D.Info.ElemBits = p.elemBits()
 
-	db_elems, elems_per_entry, entries_per_elem := Num_DB_entries(Num, row_length, p.P)
+	_, elems_per_entry, entries_per_elem := Num_DB_entries(Num, row_length, p.P)
 	D.Info.Ne = elems_per_entry
 	D.Info.X = D.Info.Ne
 	D.Info.Packing = entries_per_elem
@@ -102,58 +250,114 @@ func SetupDB(Num, row_length uint64, p *Params) *Database {
 	D.Info.Basis = 0
 	D.Info.Squishing = 0
 
-	fmt.Printf("Total packed DB size is ~%f MB\n", float64(p.L*p.M)*math.Log2(float64(p.P))/(1024.0*1024.0*8.0))
+	logf("Total packed DB size is ~%f MB\n", float64(p.L*p.M)*math.Log2(float64(p.P))/(1024.0*1024.0*8.0))
 
-	if db_elems > p.L*p.M {
-		panic("Parameters and database size do not match")
-	}
-	if p.L%D.Info.Ne != 0 {
-		panic("Number of DB elements per entry must divide the database height")
+	return D, nil
+}
+
+// SetupDB is like NewDatabase but panics on error.
+func SetupDB(Num, row_length uint64, p *Params) *Database {
+	D, err := NewDatabase(Num, row_length, p)
+	if err != nil {
+		panic(err)
 	}
 	return D
 }
 
-// MakeRandomDB creates a new database with random entries.
-func MakeRandomDB(Num, row_length uint64, p *Params) *Database {
-	D := SetupDB(Num, row_length, p)
-	D.Data = MatrixRand(p.L, p.M, 0, p.P)
+// NewRandomDatabase creates a new database with random entries.
+func NewRandomDatabase(Num, row_length uint64, p *Params) (*Database, error) {
+	D, err := NewDatabase(Num, row_length, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.wide() {
+		D.Data = MatrixRand64(p.L, p.M, 0, p.P)
+	} else {
+		D.Data = MatrixRand(p.L, p.M, 0, p.P)
+	}
 	D.Data.Sub(p.P / 2)
+	return D, nil
+}
+
+// MakeRandomDB is like NewRandomDatabase but panics on error.
+func MakeRandomDB(Num, row_length uint64, p *Params) *Database {
+	D, err := NewRandomDatabase(Num, row_length, p)
+	if err != nil {
+		panic(err)
+	}
 	return D
 }
 
-// MakeDB creates a new database with specified entries.
+// NewDatabaseFromValues creates a new database with specified entries.
+func NewDatabaseFromValues(Num, row_length uint64, p *Params, vals []uint64) (*Database, error) {
+	if uint64(len(vals)) != Num {
+		return nil, fmt.Errorf("%w: got %d values for %d entries", ErrInvalidParams, len(vals), Num)
+	}
+	b, err := NewDBBuilder(Num, row_length, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vals {
+		if err := b.Add(v); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// MakeDB is like NewDatabaseFromValues but panics on error.
 func MakeDB(Num, row_length uint64, p *Params, vals []uint64) *Database {
-	D := SetupDB(Num, row_length, p)
-	D.Data = MatrixZeros(p.L, p.M)
+	D, err := NewDatabaseFromValues(Num, row_length, p, vals)
+	if err != nil {
+		panic(err)
+	}
+	return D
+}
 
-	if uint64(len(vals)) != Num {
-		panic("Bad input DB")
-	}
-
-	if D.Info.Packing > 0 {
-		// Pack multiple DB elems into each Z_p elem
-		at := uint64(0)
-		cur := uint64(0)
-		coeff := uint64(1)
-		for i, elem := range vals {
-			cur += (elem * coeff)
-			coeff *= (1 << row_length)
-			if ((i+1)%int(D.Info.Packing) == 0) || (i == len(vals)-1) {
-				D.Data.Set(cur, at/p.M, at%p.M)
-				at += 1
-				cur = 0
-				coeff = 1
-			}
+// NewDatabaseFromBytes creates a new database whose entries are byte strings
+// of recordLen bytes each. Every record is read as a big-endian integer and
+// split into base-p digits, so records may be much wider than 64 bits.
+func NewDatabaseFromBytes(Num, recordLen uint64, p *Params, records [][]byte) (*Database, error) {
+	if uint64(len(records)) != Num {
+		return nil, fmt.Errorf("%w: got %d records for %d entries", ErrInvalidParams, len(records), Num)
+	}
+	for i, rec := range records {
+		if uint64(len(rec)) != recordLen {
+			return nil, fmt.Errorf("%w: record %d has %d bytes, expected %d", ErrInvalidParams, i, len(rec), recordLen)
 		}
-	} else {
-		// Use multiple Z_p elems to represent each DB elem
-		for i, elem := range vals {
-			for j := uint64(0); j < D.Info.Ne; j++ {
-				D.Data.Set(Base_p(D.Info.P, elem, j), (uint64(i)/p.M)*D.Info.Ne+j, uint64(i)%p.M)
-			}
+	}
+
+	b, err := NewDBBuilder(Num, 8*recordLen, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		if err := b.AddBytes(rec); err != nil {
+			return nil, err
 		}
 	}
+	return b.Finish()
+}
 
-	D.Data.Sub(p.P / 2)
+// MakeDBBytes is like NewDatabaseFromBytes but panics on error.
+func MakeDBBytes(Num, recordLen uint64, p *Params, records [][]byte) *Database {
+	D, err := NewDatabaseFromBytes(Num, recordLen, p, records)
+	if err != nil {
+		panic(err)
+	}
 	return D
 }
+
+// GetElemBytes retrieves a byte-string entry from the database by its index.
+func (DB *Database) GetElemBytes(i uint64) []byte {
+	if i >= DB.Info.Num {
+		panic(fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, DB.Info.Num))
+	}
+	row, col := DB.Info.entryPosition(i, DB.Data.Cols)
+
+	var vals []uint64
+	for j := row * DB.Info.Ne; j < (row+1)*DB.Info.Ne; j++ {
+		vals = append(vals, DB.Data.Get(j, col))
+	}
+	return ReconstructBytes(vals, i, DB.Info)
+}
@@ -0,0 +1,376 @@
+package pir
+
+// #cgo CFLAGS: -O3 -march=native
+// #include "pir.h"
+import "C"
+import (
+	"fmt"
+	"math"
+)
+
+// DoublePIR runs GulliverPIR twice to shrink the offline download. The first
+// layer answers a query against the database as usual. Instead of sending the
+// L-by-N hint H = DB·A, the server treats the base-p digits of H and of the
+// first-level answer as a second database with one column per record row,
+// and the client retrieves its row with a second LWR query. The client then
+// only downloads the hint of that second layer, whose size depends on N but
+// not on L.
+//
+// That hint has κ·Ne·N² entries, where κ is the number of base-p2 digits of
+// an element of Z_Q, against L·N for GulliverPIR; at N=1024 it takes 16 MB
+// for 1-element records. DoublePIR therefore only shrinks the hint once the
+// database has more than κ·Ne·N rows, and its answers are always larger,
+// since they carry the hint of the answer digits. With N=1024, logQ=32 and
+// 1-element records, the hints are equal at 2^24 records and DoublePIR pays
+// off from 2^25 on; MinRecords gives the bound for other parameters.
+type DoublePIR struct{}
+
+// Name returns the name of the PIR scheme.
+func (pi *DoublePIR) Name() string {
+	return "DoublePIR"
+}
+
+// PickParams picks the first-level parameters exactly like GulliverPIR;
+// the second level is derived from them by hintParams.
+func (pi *DoublePIR) PickParams(N, d, n, logQ, logq uint64) Params {
+	return (&GulliverPIR{}).PickParams(N, d, n, logQ, logq)
+}
+
+// PickSecureParams is like GulliverPIR.PickSecureParams. The second level
+// uses the same secret dimension and moduli with fewer samples, so it is at
+// least as secure as the first.
+func (pi *DoublePIR) PickSecureParams(N, d, n, logQ, logq uint64, target float64) (Params, error) {
+	return (&GulliverPIR{}).PickSecureParams(N, d, n, logQ, logq, target)
+}
+
+// hintParams returns the parameters of the second LWR layer. Its database
+// holds the digits of the hint and answer rows, one column per group of
+// info.Ne rows, so its queries have length p.L/info.Ne.
+func (pi *DoublePIR) hintParams(p Params, info DBinfo) Params {
+	ne := info.Ne
+	if ne == 0 {
+		// Init may be called before the database shape is known.
+		ne = 1
+	}
+	p2 := p
+	p2.M = p.L / ne
+	p2.P = pickPlaintextModulus(p2, defaultLogFailure)
+	p2.L = ne * p.N * Compute_num_entries_base_p(p2.P, p.LogQ)
+	return p2
+}
+
+// Init initializes the state for the PIR scheme.
+func (pi *DoublePIR) Init(info DBinfo, p Params) State {
+	shared, _ := pi.InitCompressed(info, p)
+	return shared
+}
+
+// InitCompressed initializes the shared state from a fresh PRG seed and
+// returns the seed alongside it.
+func (pi *DoublePIR) InitCompressed(info DBinfo, p Params) (State, CompressedState) {
+	comp := MakeCompressedState(RandomPRGKey())
+	return pi.DecompressState(info, p, comp), comp
+}
+
+// DecompressState rebuilds both public matrices from their PRG seed.
+func (pi *DoublePIR) DecompressState(info DBinfo, p Params, comp CompressedState) State {
+	p2 := pi.hintParams(p, info)
+	prg := NewBufPRG(NewPRG(comp.Seed))
+	A1 := MatrixRandPRG(prg, p.M, p.N, p.LogQ, 0)
+	A2 := MatrixRandPRG(prg, p2.M, p2.N, p2.LogQ, 0)
+	return MakeState(A1, A2)
+}
+
+// errNarrowOnly reports that pi does not support 64-bit elements: its second
+// layer relies on the 32-bit digit layout of the hint.
+func errNarrowOnly(pi PIR) error {
+	return fmt.Errorf("%w: %s supports only 32-bit elements", ErrInvalidParams, pi.Name())
+}
+
+// digitMatrix splits every entry of X, taken mod 2^logmod, into base-p digits
+// and lays them out for the second layer: column c holds the digits of rows
+// c*ne, ..., (c+1)*ne-1 of X, so one second-level query fetches all of them.
+func digitMatrix(X *Matrix, ne, p, logmod uint64) *Matrix {
+	kappa := Compute_num_entries_base_p(p, logmod)
+	mask := uint64(1<<logmod) - 1
+	out := MatrixNew(ne*X.Cols*kappa, X.Rows/ne)
+	for c := uint64(0); c < out.Cols; c++ {
+		for e := uint64(0); e < ne; e++ {
+			for n := uint64(0); n < X.Cols; n++ {
+				val := uint64(X.Data[(c*ne+e)*X.Cols+n]) & mask
+				for t := uint64(0); t < kappa; t++ {
+					out.Data[((e*X.Cols+n)*kappa+t)*out.Cols+c] = C.Elem(val % p)
+					val /= p
+				}
+			}
+		}
+	}
+	return out
+}
+
+// undigit decodes the second-level answer ans using the hint term hs and
+// reassembles every group of digits into a value mod 2^logmod.
+func undigit(ans, hs *Matrix, offset uint64, p2 Params, logmod uint64) []uint64 {
+	kappa := Compute_num_entries_base_p(p2.P, logmod)
+	mask := uint64(1<<logmod) - 1
+	vals := make([]uint64, ans.Rows/kappa)
+	digits := make([]uint64, kappa)
+	for j := range vals {
+		for t := uint64(0); t < kappa; t++ {
+			r := uint64(j)*kappa + t
+			digits[t] = (denoise(uint64(hs.Data[r]), uint64(ans.Data[r]), offset, p2) + p2.P/2) % p2.P
+		}
+		vals[j] = Reconstruct_from_base_p(p2.P, digits) & mask
+	}
+	return vals
+}
+
+// Setup computes the first-level hint, turns its digits into the
+// second-level database and returns the hint of that second level.
+func (pi *DoublePIR) Setup(DB *Database, shared State, p Params) (*ServerDB, Msg, error) {
+	if err := checkMsg(shared.Data, 2, "shared state"); err != nil {
+		return nil, Msg{}, err
+	}
+	if p.wide() {
+		return nil, Msg{}, errNarrowOnly(pi)
+	}
+	A1, A2 := shared.Data[0], shared.Data[1]
+	p2 := pi.hintParams(p, DB.Info)
+	if err := p.Validate(DB.Info.Row_length, DB.Info.Num); err != nil {
+		return nil, Msg{}, err
+	}
+	if err := p2.Validate(uint64(math.Log2(float64(p2.P))), p2.L*p2.M); err != nil {
+		return nil, Msg{}, fmt.Errorf("second level: %w", err)
+	}
+	if DB.Data == nil || DB.Data.Rows != p.L || A1.Cols != p.N || A2.Rows != p2.M || A2.Cols != p2.N {
+		return nil, Msg{}, fmt.Errorf("%w: database or shared state does not match params", ErrDimensionMismatch)
+	}
+	if err := CheckMatrixMul(DB.Data, A1); err != nil {
+		return nil, Msg{}, err
+	}
+
+	server, err := NewServerDB(DB)
+	if err != nil {
+		return nil, Msg{}, err
+	}
+	H1 := MatrixMul(DB.Data, A1)
+
+	hintDB := &Database{
+		Info: DBinfo{
+			Num:        p2.L * p2.M,
+			Row_length: uint64(math.Log2(float64(p2.P))),
+			Packing:    1,
+			Ne:         1,
+			X:          1,
+			P:          p2.P,
+			Logq:       p2.LogQ,
+		},
+		Data: digitMatrix(H1, DB.Info.Ne, p2.P, p.LogQ),
+	}
+	hintDB.Data.Sub(p2.P / 2)
+	if server.hint, err = NewServerDB(hintDB); err != nil {
+		return nil, Msg{}, err
+	}
+	H2 := MatrixMul(hintDB.Data, A2)
+	return server, MakeMsg(H2), nil
+}
+
+// Query generates the first-level query for the column of entry i and the
+// second-level query for its row.
+func (pi *DoublePIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg, error) {
+	if i >= info.Num {
+		return State{}, Msg{}, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, info.Num)
+	}
+	if info.Squishing == 0 {
+		return State{}, Msg{}, fmt.Errorf("%w: database info is missing compression settings", ErrInvalidParams)
+	}
+	if p.wide() {
+		return State{}, Msg{}, errNarrowOnly(pi)
+	}
+	if err := checkMsg(shared.Data, 2, "shared state"); err != nil {
+		return State{}, Msg{}, err
+	}
+	A1, A2 := shared.Data[0], shared.Data[1]
+	p2 := pi.hintParams(p, info)
+	if A1.Rows != p.M || A1.Cols != p.N || A2.Rows != p2.M || A2.Cols != p2.N {
+		return State{}, Msg{}, fmt.Errorf("%w: shared state does not match params", ErrDimensionMismatch)
+	}
+
+	row, col := info.entryPosition(i, p.M)
+	s1, q1 := lwrQuery(A1, col, p, info.Squishing)
+	s2, q2 := lwrQuery(A2, row, p2, info.Squishing)
+	return MakeState(s1, s2), MakeMsg(q1, q2), nil
+}
+
+// Answer answers a single query. The answer carries the second-level answer
+// over the hint digits, the second-level answer over the digits of the
+// first-level answer, and the hint for the latter, which depends on the query
+// and therefore cannot be sent offline.
+func (pi *DoublePIR) Answer(server *ServerDB, query MsgSlice, shared State, p Params) (Msg, error) {
+	if len(query.Data) != 1 {
+		return Msg{}, fmt.Errorf("%w: %s answers one query at a time, got %d", ErrMalformedMsg, pi.Name(), len(query.Data))
+	}
+	if server.hint == nil {
+		return Msg{}, fmt.Errorf("%w: database was not set up for %s", ErrInvalidParams, pi.Name())
+	}
+	if err := checkMsg(shared.Data, 2, "shared state"); err != nil {
+		return Msg{}, err
+	}
+	q := query.Data[0]
+	if err := checkMsg(q.Data, 2, "query"); err != nil {
+		return Msg{}, err
+	}
+	q1, q2 := q.Data[0], q.Data[1]
+	info, hintInfo := server.info, server.hint.info
+	if err := CheckMatrixMulVecPacked(server.data, q1, info.Basis, info.Squishing); err != nil {
+		return Msg{}, err
+	}
+	if err := CheckMatrixMulVecPacked(server.hint.data, q2, hintInfo.Basis, hintInfo.Squishing); err != nil {
+		return Msg{}, err
+	}
+	A2 := shared.Data[1]
+	p2 := pi.hintParams(p, info)
+
+	a1 := MatrixMulVecPacked(server.data, q1, info.Basis, info.Squishing)
+	digits := digitMatrix(a1, info.Ne, p2.P, p.Logq)
+	if err := CheckMatrixMulVec(digits, q2); err != nil {
+		return Msg{}, err
+	}
+	if err := CheckMatrixMul(digits, A2); err != nil {
+		return Msg{}, err
+	}
+	ansA := MatrixMulVec(digits, q2)
+	digits.Sub(p2.P / 2)
+	hintA := MatrixMul(digits, A2)
+
+	ansH := MatrixMulVecPacked(server.hint.data, q2, hintInfo.Basis, hintInfo.Squishing)
+	return MakeMsg(ansH, ansA, hintA), nil
+}
+
+// Recover first decodes the second level to obtain the hint rows and the
+// first-level answer entries of record i, then decodes the first level.
+func (pi *DoublePIR) Recover(i uint64, batchIndex uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) (uint64, error) {
+	vals, err := pi.recoverVals(i, offline, query, answer, client, p, info)
+	if err != nil {
+		return 0, err
+	}
+	return ReconstructElem(vals, i, info), nil
+}
+
+// RecoverBytes is like Recover for databases built by NewDatabaseFromBytes.
+func (pi *DoublePIR) RecoverBytes(i uint64, batchIndex uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) ([]byte, error) {
+	vals, err := pi.recoverVals(i, offline, query, answer, client, p, info)
+	if err != nil {
+		return nil, err
+	}
+	return ReconstructBytes(vals, i, info), nil
+}
+
+// recoverVals returns the Z_p elements that represent entry i.
+func (pi *DoublePIR) recoverVals(i uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) ([]uint64, error) {
+	if i >= info.Num {
+		return nil, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, info.Num)
+	}
+	if p.wide() {
+		return nil, errNarrowOnly(pi)
+	}
+	for _, c := range []struct {
+		data []*Matrix
+		n    int
+		what string
+	}{{client.Data, 2, "client state"}, {offline.Data, 1, "hint"}, {query.Data, 2, "query"}, {answer.Data, 3, "answer"}} {
+		if err := checkMsg(c.data, c.n, c.what); err != nil {
+			return nil, err
+		}
+	}
+	s1, s2 := client.Data[0], client.Data[1]
+	H2 := offline.Data[0]
+	q1, q2 := query.Data[0], query.Data[1]
+	ansH, ansA, hintA := answer.Data[0], answer.Data[1], answer.Data[2]
+	p2 := pi.hintParams(p, info)
+
+	// The server picks the shapes of the hint and answer, so check every
+	// component against params before multiplying or indexing into it.
+	ansRowsLen := info.Ne * Compute_num_entries_base_p(p2.P, p.Logq)
+	for _, c := range []struct {
+		m          *Matrix
+		rows, cols uint64
+		what       string
+	}{
+		{s1, p.N, 1, "first-level secret"}, {s2, p2.N, 1, "second-level secret"},
+		{H2, p2.L, p2.N, "hint"},
+		{ansH, p2.L, 1, "hint digits answer"}, {ansA, ansRowsLen, 1, "answer digits answer"},
+		{hintA, ansRowsLen, p2.N, "answer digits hint"},
+	} {
+		if err := checkShape(c.m, c.rows, c.cols, p.wide(), c.what); err != nil {
+			return nil, err
+		}
+	}
+	if q1.Rows < p.M || q2.Rows < p2.M {
+		return nil, fmt.Errorf("%w: query too short", ErrDimensionMismatch)
+	}
+
+	offset2 := queryOffset(q2, p2)
+	hintRows := undigit(ansH, MatrixMul(H2, s2), offset2, p2, p.LogQ)
+	ansRows := undigit(ansA, MatrixMul(hintA, s2), offset2, p2, p.Logq)
+
+	offset1 := queryOffset(q1, p)
+	var vals []uint64
+	for e := uint64(0); e < info.Ne; e++ {
+		var hs C.Elem
+		for n := uint64(0); n < p.N; n++ {
+			hs += C.Elem(hintRows[e*p.N+n]) * s1.Data[n]
+		}
+		vals = append(vals, denoise(uint64(hs), ansRows[e], offset1, p))
+	}
+	return vals, nil
+}
+
+// HintSize returns the size in KB of the hint that Setup would produce for
+// a database described by info, without building it.
+func (pi *DoublePIR) HintSize(p Params, info DBinfo) float64 {
+	p2 := pi.hintParams(p, info)
+	return calculateCommunicationSize(p2.L*p2.N, p2.LogQ)
+}
+
+// MinRecords returns the smallest power of two d such that, for a database
+// of d Z_p elements grouped into records of ne elements, the hint of
+// DoublePIR is smaller than that of GulliverPIR under
+// PickParams(N, d, n, logQ, logq). It returns 0 if there is none below 2^62.
+func (pi *DoublePIR) MinRecords(N, n, logQ, logq, ne uint64) uint64 {
+	info := DBinfo{Ne: ne}
+	for d := uint64(1) << 10; d <= 1<<62; d <<= 1 {
+		p := pi.PickParams(N, d, n, logQ, logq)
+		if pi.HintSize(p, info) < (&GulliverPIR{}).HintSize(p, info) {
+			return d
+		}
+	}
+	return 0
+}
+
+// OfflineSize returns the size of the second-level hint in KB.
+func (pi *DoublePIR) OfflineSize(offline Msg, p Params) float64 {
+	return calculateCommunicationSize(offline.Size(), p.LogQ)
+}
+
+// QuerySize returns the size of both queries in KB; their entries live in Z_q.
+func (pi *DoublePIR) QuerySize(query Msg, p Params) float64 {
+	return calculateCommunicationSize(query.Size(), p.Logq)
+}
+
+// AnswerSize returns the size of an answer in KB. The two answer vectors
+// live in Z_q, while the hint for the answer digits lives in Z_Q.
+func (pi *DoublePIR) AnswerSize(answer Msg, p Params) float64 {
+	var size float64
+	for j, m := range answer.Data {
+		if j == 2 {
+			size += calculateCommunicationSize(m.Size(), p.LogQ)
+		} else {
+			size += calculateCommunicationSize(m.Size(), p.Logq)
+		}
+	}
+	return size
+}
@@ -0,0 +1,51 @@
+package pir
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the pir package. Functions wrap them with additional
+// context, so callers should compare using errors.Is. The panicking helpers
+// (MatrixMul, SetupDB, ...) panic with the same wrapped errors.
+var (
+	ErrInvalidParams     = errors.New("invalid parameters")
+	ErrDimensionMismatch = errors.New("dimension mismatch")
+	ErrIndexOutOfRange   = errors.New("index out of range")
+	ErrMalformedMsg      = errors.New("malformed message or state")
+	ErrRandomness        = errors.New("randomness failure")
+	ErrNotFound          = errors.New("key not found")
+	ErrInsecureParams    = errors.New("insecure parameters")
+	ErrMalformedRecords  = errors.New("malformed records")
+	ErrCapacityExhausted = errors.New("database capacity exhausted")
+)
+
+// dimensionError reports that a and b cannot be combined.
+func dimensionError(a, b *Matrix) error {
+	return fmt.Errorf("%w: %d-by-%d vs. %d-by-%d", ErrDimensionMismatch, a.Rows, a.Cols, b.Rows, b.Cols)
+}
+
+// checkShape ensures that m, a component of a message or state, is a
+// rows-by-cols matrix whose entries have the given width.
+func checkShape(m *Matrix, rows, cols uint64, wide bool, what string) error {
+	if m.Wide != wide {
+		return fmt.Errorf("%w: %s has entries of the wrong width", ErrMalformedMsg, what)
+	}
+	if m.Rows != rows || m.Cols != cols {
+		return fmt.Errorf("%w: %s is %d-by-%d, expected %d-by-%d", ErrDimensionMismatch, what, m.Rows, m.Cols, rows, cols)
+	}
+	return nil
+}
+
+// checkMsg ensures that a Msg or State payload carries at least n matrices.
+func checkMsg(data []*Matrix, n int, what string) error {
+	if len(data) < n {
+		return fmt.Errorf("%w: %s has %d components, expected %d", ErrMalformedMsg, what, len(data), n)
+	}
+	for i := 0; i < n; i++ {
+		if data[i] == nil {
+			return fmt.Errorf("%w: %s component %d is missing", ErrMalformedMsg, what, i)
+		}
+	}
+	return nil
+}
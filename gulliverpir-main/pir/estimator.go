@@ -0,0 +1,155 @@
+package pir
+
+import (
+	"fmt"
+	"math"
+)
+
+// Security estimation for the LWR instances used by the schemes. An LWR
+// sample round((q/Q)·⟨a, s⟩) is treated as an LWE sample modulo Q whose error
+// is uniform over an interval of width Q/q. We estimate the cost of the
+// primal (uSVP) and dual attacks in the core-SVP model, where BKZ with block
+// size β costs 2^(0.292β) operations, and let the attacker use any number of
+// the M samples exposed by a query.
+
+const (
+	coreSVPExponent = 0.292
+	minBlockSize    = 40
+)
+
+// SecurityEstimate holds the estimated bit security of an LWR instance
+// against each attack.
+type SecurityEstimate struct {
+	Primal float64 // log2 cost of the primal uSVP attack
+	Dual   float64 // log2 cost of the dual distinguishing attack
+}
+
+// Bits returns the bit security of the instance, i.e. the cost of the
+// cheapest attack.
+func (e SecurityEstimate) Bits() float64 {
+	return math.Min(e.Primal, e.Dual)
+}
+
+func (e SecurityEstimate) String() string {
+	return fmt.Sprintf("%.1f bits (primal %.1f, dual %.1f)", e.Bits(), e.Primal, e.Dual)
+}
+
+// roundingStdDev returns the standard deviation of the rounding error of a
+// query entry, measured modulo Q.
+func (p *Params) roundingStdDev() float64 {
+	return float64(uint64(1)<<(p.LogQ-p.Logq)) / math.Sqrt(12)
+}
+
+// logRootHermite returns log2 of the root-Hermite factor reached by BKZ with
+// block size beta.
+func logRootHermite(beta float64) float64 {
+	return math.Log2(math.Pow(math.Pi*beta, 1/beta)*beta/(2*math.Pi*math.E)) / (2 * (beta - 1))
+}
+
+// sampleCounts returns the numbers of samples tried by the attacks, at most
+// maxSamples. Without samples, the attacks only get the trivial lattice.
+func sampleCounts(maxSamples uint64) []float64 {
+	if maxSamples == 0 {
+		return []float64{0}
+	}
+	step := maxSamples / 64
+	if step == 0 {
+		step = 1
+	}
+	var out []float64
+	for m := step; m <= maxSamples; m += step {
+		out = append(out, float64(m))
+	}
+	return out
+}
+
+// estimatePrimal returns the log2 cost of the primal attack: the smallest
+// block size β such that BKZ-β recovers the error and (rescaled) secret as
+// the unique shortest vector of the embedding lattice, following the 2016
+// estimate sqrt(β)·σ ≤ δ^(2β-d)·Vol^(1/d). If no smaller block size
+// satisfies it, the attacker reduces the whole lattice with β = d, so the
+// estimate stays finite for small dimensions.
+func estimatePrimal(n, samples, logQ, sigmaS, sigmaE float64) float64 {
+	best := math.Inf(1)
+	logNu := math.Log2(sigmaE / sigmaS)
+	for _, m := range sampleCounts(uint64(samples)) {
+		d := m + n + 1
+		logVol := m*logQ + n*logNu
+		beta := math.Min(minBlockSize, d)
+		for ; beta < d; beta++ {
+			lhs := math.Log2(sigmaE) + math.Log2(beta)/2
+			rhs := (2*beta-d)*logRootHermite(beta) + logVol/d
+			if lhs <= rhs {
+				break
+			}
+		}
+		best = math.Min(best, coreSVPExponent*beta)
+	}
+	return best
+}
+
+// estimateDual returns the log2 cost of the dual attack: BKZ-β finds a short
+// vector of the (rescaled) dual lattice, whose inner product with a sample
+// is distinguishable from uniform with advantage ε = exp(-2π²(ℓσ/Q)²). The
+// attack is repeated 1/ε² times.
+func estimateDual(n, samples, logQ, sigmaS, sigmaE float64) float64 {
+	best := math.Inf(1)
+	logC := math.Log2(sigmaS / sigmaE)
+	for _, m := range sampleCounts(uint64(samples)) {
+		d := m + n
+		logVol := n*logQ + n*logC
+		for beta := math.Min(minBlockSize, d); beta <= d; beta++ {
+			logLen := d*logRootHermite(beta) + logVol/d
+			x := math.Exp2(logLen + math.Log2(sigmaE) - logQ)
+			repeats := 4 * math.Pi * math.Pi * x * x * math.Log2E
+			best = math.Min(best, coreSVPExponent*beta+repeats)
+		}
+	}
+	return best
+}
+
+// EstimateSecurity estimates the bit security of the LWR instance defined by
+// p, with the M samples seen by one query. Sparse secrets are only accounted
+// for through their variance; hybrid attacks that guess the support are not
+// covered.
+func EstimateSecurity(p Params) SecurityEstimate {
+	if p.N == 0 || p.secretStdDev() == 0 || p.LogQ <= p.Logq {
+		// A missing or fixed secret, or no rounding at all, offers no
+		// security.
+		return SecurityEstimate{}
+	}
+	n, m, logQ := float64(p.N), float64(p.M), float64(p.LogQ)
+	sigmaS, sigmaE := p.secretStdDev(), p.roundingStdDev()
+	return SecurityEstimate{
+		Primal: estimatePrimal(n, m, logQ, sigmaS, sigmaE),
+		Dual:   estimateDual(n, m, logQ, sigmaS, sigmaE),
+	}
+}
+
+// CheckSecurity returns an error wrapping ErrInsecureParams if p is
+// estimated to offer less than target bits of security.
+func (p *Params) CheckSecurity(target float64) error {
+	est := EstimateSecurity(*p)
+	if est.Bits() < target {
+		return fmt.Errorf("%w: %s, target is %.0f bits", ErrInsecureParams, est, target)
+	}
+	return nil
+}
+
+// maxSecretDimension bounds the secret dimension tried by PickSecureParams.
+const maxSecretDimension = 1 << 13
+
+// pickSecureParams calls pick with growing secret dimensions, starting at n
+// and doubling, until the parameters reach target bits of security.
+func pickSecureParams(pick func(n uint64) Params, n uint64, target float64) (Params, error) {
+	for ; n <= maxSecretDimension; n *= 2 {
+		p := pick(n)
+		est := EstimateSecurity(p)
+		if est.Bits() >= target {
+			return p, nil
+		}
+		logf("Security %s below %.0f bits, increasing n\n", est, target)
+	}
+	return Params{}, fmt.Errorf("%w: no secret dimension up to %d reaches %.0f bits",
+		ErrInsecureParams, maxSecretDimension, target)
+}
@@ -0,0 +1,156 @@
+package pir
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// ExploreGrid describes the settings tabulated by Explore. Every combination
+// of the listed values gives one row.
+type ExploreGrid struct {
+	N          []uint64 // secret dimensions
+	LogD       []uint64 // (logarithm of) number of records
+	RecordBits []uint64 // record sizes in bits
+	LogQ       []uint64 // (logarithm of) hint moduli
+	Logq       []uint64 // (logarithm of) query moduli
+
+	Weights CostWeights // weights used to plan each database shape
+	Time    bool        // whether to measure Setup and Answer
+}
+
+// ExploreRow holds the parameters PlanParams picks for one setting of an
+// ExploreGrid, with their predicted costs. Rows that cannot be planned or
+// measured carry the reason in Err.
+type ExploreRow struct {
+	N          uint64 `json:"n"`
+	LogD       uint64 `json:"log_d"`
+	RecordBits uint64 `json:"record_bits"`
+	LogQ       uint64 `json:"log_Q"`
+	Logq       uint64 `json:"log_q"`
+
+	P  uint64 `json:"p"`
+	L  uint64 `json:"l"`
+	M  uint64 `json:"m"`
+	Ne uint64 `json:"ne"`
+
+	HintBytes   uint64  `json:"hint_bytes"`
+	QueryBytes  uint64  `json:"query_bytes"`
+	AnswerBytes uint64  `json:"answer_bytes"`
+	Security    float64 `json:"security_bits"`
+	LogFailure  float64 `json:"log2_failure"`
+
+	SetupSeconds  float64 `json:"setup_seconds,omitempty"`
+	AnswerSeconds float64 `json:"answer_seconds,omitempty"`
+
+	Err string `json:"error,omitempty"`
+}
+
+// ExploreHeader returns the CSV column names matching ExploreRow.Record.
+func ExploreHeader() []string {
+	return []string{"n", "log_d", "record_bits", "log_Q", "log_q", "p", "l", "m", "ne",
+		"hint_bytes", "query_bytes", "answer_bytes", "security_bits", "log2_failure",
+		"setup_seconds", "answer_seconds", "error"}
+}
+
+// Record returns the row as CSV fields, in the order of ExploreHeader.
+func (r *ExploreRow) Record() []string {
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	return []string{u(r.N), u(r.LogD), u(r.RecordBits), u(r.LogQ), u(r.Logq), u(r.P), u(r.L), u(r.M), u(r.Ne),
+		u(r.HintBytes), u(r.QueryBytes), u(r.AnswerBytes), f(r.Security), f(r.LogFailure),
+		strconv.FormatFloat(r.SetupSeconds, 'f', 6, 64), strconv.FormatFloat(r.AnswerSeconds, 'f', 6, 64), r.Err}
+}
+
+// Explore plans every setting of g with GulliverPIR and returns one row per
+// setting, in the order of the grid with N varying slowest. If g.Time is set,
+// it also builds a random database for every row and times Setup and Answer.
+func Explore(g ExploreGrid) []ExploreRow {
+	var rows []ExploreRow
+	for _, n := range g.N {
+		for _, logD := range g.LogD {
+			for _, bits := range g.RecordBits {
+				for _, logQ := range g.LogQ {
+					for _, logq := range g.Logq {
+						row, p := exploreRow(n, logD, bits, logQ, logq, g.Weights)
+						if g.Time && row.Err == "" {
+							if err := row.measure(p); err != nil {
+								row.Err = err.Error()
+							}
+						}
+						rows = append(rows, row)
+					}
+				}
+			}
+		}
+	}
+	return rows
+}
+
+// exploreRow plans a single setting and returns its row with the planned
+// parameters.
+func exploreRow(n, logD, recordBits, logQ, logq uint64, w CostWeights) (ExploreRow, Params) {
+	row := ExploreRow{N: n, LogD: logD, RecordBits: recordBits, LogQ: logQ, Logq: logq}
+	if logD >= 64 {
+		row.Err = fmt.Sprintf("%v: log_d=%d", ErrInvalidParams, logD)
+		return row, Params{}
+	}
+	plan, err := PlanParams(uint64(1)<<logD, recordBits, n, logQ, logq, w)
+	if err != nil {
+		row.Err = err.Error()
+		return row, Params{}
+	}
+	p := plan.Params
+	row.P, row.L, row.M, row.Ne = p.P, p.L, p.M, plan.Ne
+	row.HintBytes, row.QueryBytes, row.AnswerBytes = plan.OfflineBytes, plan.UploadBytes, plan.DownloadBytes
+	row.Security = EstimateSecurity(p).Bits()
+	row.LogFailure = LogFailureProbability(p, DBinfo{Ne: plan.Ne})
+	if !isFinite(row.Security) || !isFinite(row.LogFailure) {
+		// Keep the row encodable as JSON, which has no infinities.
+		row.Err = fmt.Sprintf("non-finite estimate: %v security bits, log2 failure %v", row.Security, row.LogFailure)
+		row.Security, row.LogFailure = 0, 0
+		return row, Params{}
+	}
+	return row, p
+}
+
+func isFinite(v float64) bool {
+	return !math.IsInf(v, 0) && !math.IsNaN(v)
+}
+
+// measure times the setup of a random database with parameters p and the
+// answer to a single query.
+func (r *ExploreRow) measure(p Params) error {
+	num := uint64(1) << r.LogD
+	DB, err := NewRandomDatabase(num, r.RecordBits, &p)
+	if err != nil {
+		return err
+	}
+
+	pir := GulliverPIR{}
+	start := time.Now()
+	server, err := NewServer(&pir, DB, p)
+	if err != nil {
+		return err
+	}
+	r.SetupSeconds = time.Since(start).Seconds()
+
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		return err
+	}
+	_, query, err := client.Query(RandInt(new(big.Int).SetUint64(num)).Uint64())
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	if _, err := server.Answer(query); err != nil {
+		return err
+	}
+	r.AnswerSeconds = time.Since(start).Seconds()
+	return nil
+}
@@ -0,0 +1,61 @@
+package pir
+
+import (
+	"math"
+)
+
+// Correctness analysis. Write Δ = q/P and let e_j ∈ [-1/2, 1/2] be the error
+// of rounding (q/Q)·(A·s)_j in Query. Answer row i then equals
+// (q/Q)·(H·s)_i + Δ·D_i,col - Σ_j D_i,j·e_j mod q, and Recover subtracts the
+// hint term, which it scales from Z_Q to Z_P without rounding, so the hint
+// adds no error of its own. Decoding fails when the remaining noise
+// |Σ_j D_i,j·e_j| reaches Δ/2. The sum has M terms of variance at most
+// (P/2)²/12 (for the worst-case database entry ±P/2), and we bound its tail
+// by that of a Gaussian. The secret only enters through the hint term, so
+// its distribution does not affect correctness, only security.
+
+// defaultLogFailure is the log2 failure probability per Z_p element targeted
+// by PickParams.
+const defaultLogFailure = -40
+
+// log2Erfc returns log2(erfc(x)), switching to the asymptotic expansion
+// erfc(x) ≈ exp(-x²)/(x·sqrt(π)) where erfc underflows.
+func log2Erfc(x float64) float64 {
+	if x < 25 {
+		return math.Log2(math.Erfc(x))
+	}
+	return -x*x*math.Log2E - math.Log2(x*math.Sqrt(math.Pi))
+}
+
+// logElemFailure returns log2 of the probability that a single Z_p element
+// is decoded incorrectly.
+func (p *Params) logElemFailure() float64 {
+	half := float64(p.P) / 2
+	sigma := math.Sqrt(float64(p.M)/12) * half
+	threshold := float64(uint64(1)<<p.Logq) / (2 * float64(p.P))
+	return math.Min(0, log2Erfc(threshold/(sigma*math.Sqrt2)))
+}
+
+// LogFailureProbability returns log2 of the probability that Recover returns
+// a wrong entry of a database with layout info, i.e. that any of the info.Ne
+// Z_p elements of the entry is decoded incorrectly (by a union bound).
+func LogFailureProbability(p Params, info DBinfo) float64 {
+	ne := info.Ne
+	if ne == 0 {
+		ne = 1
+	}
+	return math.Min(0, p.logElemFailure()+math.Log2(float64(ne)))
+}
+
+// pickPlaintextModulus returns the largest power of two P that fits in a
+// digit of a squished element and keeps the per-element failure probability
+// of p below 2^logTarget, or 2 if none does.
+func pickPlaintextModulus(p Params, logTarget float64) uint64 {
+	basis, _ := squishSettings(p.wide())
+	for p.P = 1 << basis; p.P > 2; p.P /= 2 {
+		if p.logElemFailure() <= logTarget {
+			break
+		}
+	}
+	return p.P
+}
@@ -4,7 +4,9 @@ package pir
 // #include "pir.h"
 import "C"
 import (
+	"fmt"
 	"math"
+	"math/bits"
 )
 
 // GulliverPIR represents the Gulliver Private Information Retrieval scheme.
@@ -27,100 +29,433 @@ func (pi *GulliverPIR) PickParams(N, d, n, logQ, logq uint64) Params {
 		Logq:    logq,
 		Uniform: uint64(1 << Delta),
 	}
-	k := float64(math.Log2(float64(d)))
-	t := (float64(logq) - k/2 + 1) / 2
-	p.P = uint64(1 << uint64(math.Floor(t)))
+	if logQ > elemBits {
+		p.ElemBits = 64
+	}
+	p.P = pickPlaintextModulus(p, defaultLogFailure)
 	p.PrintParams()
+	logf("Failure probability per Z_p element: 2^%.1f\n", p.logElemFailure())
+	logf("Estimated security: %s\n", EstimateSecurity(p))
 	return p
 }
 
+// PickSecureParams is like PickParams, but increases the secret dimension
+// from n until the parameters reach target bits of security. It returns an
+// error wrapping ErrInsecureParams if no dimension does.
+func (pi *GulliverPIR) PickSecureParams(N, d, n, logQ, logq uint64, target float64) (Params, error) {
+	return pickSecureParams(func(n uint64) Params {
+		return pi.PickParams(N, d, n, logQ, logq)
+	}, n, target)
+}
+
 // Init initializes the state for the PIR scheme.
 func (pi *GulliverPIR) Init(info DBinfo, p Params) State {
-	A := MatrixRand(p.M, p.N, p.LogQ, 0)
+	shared, _ := pi.InitCompressed(info, p)
+	return shared
+}
+
+// InitCompressed initializes the shared state from a fresh PRG seed and
+// returns the seed alongside it, so that only the seed has to be distributed.
+func (pi *GulliverPIR) InitCompressed(info DBinfo, p Params) (State, CompressedState) {
+	return pi.InitCompressedSeeded(info, p, RandomPRGKey())
+}
+
+// InitCompressedSeeded initializes the shared state from the given PRG seed.
+func (pi *GulliverPIR) InitCompressedSeeded(info DBinfo, p Params, seed *PRGKey) (State, CompressedState) {
+	comp := MakeCompressedState(seed)
+	return pi.DecompressState(info, p, comp), comp
+}
+
+// DecompressState rebuilds the public matrix A from its PRG seed.
+func (pi *GulliverPIR) DecompressState(info DBinfo, p Params, comp CompressedState) State {
+	prg := NewBufPRG(NewPRG(comp.Seed))
+	if p.wide() {
+		return MakeState(MatrixRandPRG64(prg, p.M, p.N, p.LogQ, 0))
+	}
+	A := MatrixRandPRG(prg, p.M, p.N, p.LogQ, 0)
 	return MakeState(A)
 }
 
-// Setup prepares the database and shared state for the PIR scheme.
-func (pi *GulliverPIR) Setup(DB *Database, shared State, p Params) (State, Msg) {
+// Setup computes the hint and preprocesses the database for answering.
+// DB is left untouched; the server answers from the returned ServerDB.
+func (pi *GulliverPIR) Setup(DB *Database, shared State, p Params) (*ServerDB, Msg, error) {
+	if err := checkMsg(shared.Data, 1, "shared state"); err != nil {
+		return nil, Msg{}, err
+	}
+	if err := p.Validate(DB.Info.Row_length, DB.Info.Num); err != nil {
+		return nil, Msg{}, err
+	}
 	A := shared.Data[0]
+	if DB.Data == nil || DB.Data.Rows != p.L || A.Cols != p.N {
+		return nil, Msg{}, fmt.Errorf("%w: database or shared state does not match params", ErrDimensionMismatch)
+	}
+	if err := CheckMatrixMul(DB.Data, A); err != nil {
+		return nil, Msg{}, err
+	}
+
+	server, err := NewServerDB(DB)
+	if err != nil {
+		return nil, Msg{}, err
+	}
 	H := MatrixMul(DB.Data, A)
-	DB.Data.Add(p.P / 2)
-	DB.Squish()
-	return MakeState(), MakeMsg(H)
+	return server, MakeMsg(H), nil
 }
 
 // Query generates a query for the specified index using the shared state.
-func (pi *GulliverPIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg) {
+func (pi *GulliverPIR) Query(i uint64, shared State, p Params, info DBinfo) (State, Msg, error) {
+	if i >= info.Num {
+		return State{}, Msg{}, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, info.Num)
+	}
+	if info.Squishing == 0 {
+		return State{}, Msg{}, fmt.Errorf("%w: database info is missing compression settings", ErrInvalidParams)
+	}
+	if err := checkMsg(shared.Data, 1, "shared state"); err != nil {
+		return State{}, Msg{}, err
+	}
 	A := shared.Data[0]
-	secret := MatrixRand(p.N, 1, p.Uniform, 0)
-	secret.Sub(p.Uniform / 2)
+	if A.Rows != p.M || A.Cols != p.N {
+		return State{}, Msg{}, fmt.Errorf("%w: shared matrix is %d-by-%d, expected %d-by-%d",
+			ErrDimensionMismatch, A.Rows, A.Cols, p.M, p.N)
+	}
+
+	_, col := info.entryPosition(i, p.M)
+	secret, query := lwrQuery(A, col, p, info.Squishing)
+	return MakeState(secret), MakeMsg(query), nil
+}
+
+// lwrQuery samples a secret s and returns it with the LWR query
+// round(A·s·q/Q) + (q/p)·e_col, padded to a multiple of squishing.
+func lwrQuery(A *Matrix, col uint64, p Params, squishing uint64) (*Matrix, *Matrix) {
+	secret, query := lwrQueryBase(A, p, squishing)
+	query.AddAt(p.deltai(), col, 0)
+	return secret, query
+}
+
+// lwrQueryBase is lwrQuery without the unit vector, which is the only part
+// of the query that depends on the index.
+func lwrQueryBase(A *Matrix, p Params, squishing uint64) (*Matrix, *Matrix) {
+	secret := sampleSecret(p)
 	query := MatrixMul(A, secret)
 
-	// Apply scaling and rounding to each element of the query.
-	for j := uint64(0); j < p.M; j++ {
-		query.Data[j] = C.Elem(math.Round(float64(query.Data[j]) * p.deltaq()))
+	// Apply scaling and rounding to each element of the query. Wide entries
+	// do not fit in a float64, so they are rounded with integer arithmetic.
+	for j := uint64(0); j < A.Rows; j++ {
+		if p.wide() {
+			query.Data64[j] = C.Elem64(roundShift(uint64(query.Data64[j]), p.LogQ-p.Logq))
+		} else {
+			query.Data[j] = C.Elem(math.Round(float64(query.Data[j]) * p.deltaq()))
+		}
 	}
-	query.Data[i%p.M] += C.Elem(p.deltai())
 
 	// Ensure the query dimensions match the compressed database.
-	if p.M%info.Squishing != 0 {
-		query.AppendZeros(info.Squishing - (p.M % info.Squishing))
+	if A.Rows%squishing != 0 {
+		query.AppendZeros(squishing - (A.Rows % squishing))
 	}
+	return secret, query
+}
 
-	return MakeState(secret), MakeMsg(query)
+// queryOffset returns q - (p/2)·Σ query_j mod q, which cancels the shift of
+// the database entries from [-p/2, p/2) to [0, p) done by NewServerDB.
+func queryOffset(query *Matrix, p Params) uint64 {
+	ratio := p.P / 2
+	var offset uint64
+	for j := uint64(0); j < query.Rows; j++ {
+		offset += ratio * query.Get(j, 0)
+	}
+	return lowBits(-offset, p.Logq)
+}
+
+// roundShift returns round(x / 2^shift), the integer analogue of scaling by
+// q/Q with q = Q/2^shift.
+func roundShift(x, shift uint64) uint64 {
+	if shift == 0 {
+		return x
+	}
+	return (x >> shift) + (x>>(shift-1))&1
+}
+
+// denoise removes the hint term hs = (H·s)_j from the answer entry ans and
+// rounds the result to the (shifted) Z_p element it encodes.
+func denoise(hs, ans, offset uint64, p Params) uint64 {
+	if p.wide() {
+		// Compute d = (ans+offset)·Q/q - hs mod Q and round d·P/Q.
+		logP := uint64(bits.TrailingZeros64(p.P))
+		d := lowBits((ans+offset)<<(p.LogQ-p.Logq)-hs, p.LogQ)
+		return roundShift(d, p.LogQ-logP) % p.P
+	}
+	item0 := float64(C.Elem(hs)) * p.deltah()
+	item1 := float64(C.Elem(ans+offset)) * p.deltaa()
+	return uint64(int64(math.Round(item1-item0))) % p.P
 }
 
 // Answer generates the server's response to a batch of queries.
-func (pi *GulliverPIR) Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg {
-	ans := new(Matrix)
+// It only reads from server and may be called concurrently.
+func (pi *GulliverPIR) Answer(server *ServerDB, query MsgSlice, shared State, p Params) (Msg, error) {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	DB := server.data
+	info := server.info
 	numQueries := uint64(len(query.Data))
-	batchSize := DB.Data.Rows / numQueries
+	if numQueries == 0 || numQueries > DB.Rows {
+		return Msg{}, fmt.Errorf("%w: cannot answer %d queries over %d rows", ErrMalformedMsg, numQueries, DB.Rows)
+	}
+	for _, q := range query.Data {
+		if err := checkMsg(q.Data, 1, "query"); err != nil {
+			return Msg{}, err
+		}
+		if err := CheckMatrixMulVecPacked(DB, q.Data[0], info.Basis, info.Squishing); err != nil {
+			return Msg{}, err
+		}
+	}
+
+	ans := new(Matrix)
+	batchSize := DB.Rows / numQueries
 
 	var last uint64
 	for batch, q := range query.Data {
 		if batch == int(numQueries-1) {
-			batchSize = DB.Data.Rows - last
+			batchSize = DB.Rows - last
 		}
-		a := MatrixMulVecPacked(DB.Data.SelectRows(last, batchSize),
+		a := MatrixMulVecPacked(DB.SelectRows(last, batchSize),
 			q.Data[0],
-			DB.Info.Basis,
-			DB.Info.Squishing)
+			info.Basis,
+			info.Squishing)
 		ans.Concat(a)
 		last += batchSize
 	}
-	return MakeMsg(ans)
+	return MakeMsg(ans), nil
+}
+
+// AnswerBatch answers k independent queries, each against the whole
+// database. The queries are stacked into the columns of a matrix and
+// multiplied with the squished database in a single pass, so the database
+// is streamed from memory once for the whole batch, and every packed entry
+// is unpacked once for all queries. A batch of one query is answered as by
+// Answer. The i-th returned Msg answers the i-th query and is recovered
+// exactly like the output of Answer.
+func (pi *GulliverPIR) AnswerBatch(server *ServerDB, queries MsgSlice, shared State, p Params) (MsgSlice, error) {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	DB := server.data
+	info := server.info
+	k := uint64(len(queries.Data))
+	if k == 0 {
+		return MsgSlice{}, fmt.Errorf("%w: empty batch", ErrMalformedMsg)
+	}
+	rows := DB.Cols * info.Squishing
+	for _, q := range queries.Data {
+		if err := checkMsg(q.Data, 1, "query"); err != nil {
+			return MsgSlice{}, err
+		}
+		if err := CheckMatrixMulVecPacked(DB, q.Data[0], info.Basis, info.Squishing); err != nil {
+			return MsgSlice{}, err
+		}
+	}
+
+	if k == 1 {
+		q := queries.Data[0].Data[0]
+		return MakeMsgSlice(MakeMsg(MatrixMulVecPacked(DB, q, info.Basis, info.Squishing))), nil
+	}
+
+	// Stack the queries into a rows-by-k matrix, one column per query.
+	stacked := MatrixNewWidth(rows, k, DB.Wide)
+	for j, q := range queries.Data {
+		col := q.Data[0]
+		if DB.Wide {
+			for r, v := range col.Data64[:rows] {
+				stacked.Data64[uint64(r)*k+uint64(j)] = v
+			}
+		} else {
+			for r, v := range col.Data[:rows] {
+				stacked.Data[uint64(r)*k+uint64(j)] = v
+			}
+		}
+	}
+
+	out := MatrixMulPacked(DB, stacked, info.Basis, info.Squishing)
+
+	// Split the answers back out of the columns of out.
+	var answers MsgSlice
+	for j := uint64(0); j < k; j++ {
+		ans := MatrixNewWidth(out.Rows, 1, out.Wide)
+		if out.Wide {
+			for r := range ans.Data64 {
+				ans.Data64[r] = out.Data64[uint64(r)*k+j]
+			}
+		} else {
+			for r := range ans.Data {
+				ans.Data[r] = out.Data[uint64(r)*k+j]
+			}
+		}
+		answers.Data = append(answers.Data, MakeMsg(ans))
+	}
+	return answers, nil
 }
 
 // Recover reconstructs the original database element from the query and answer.
 func (pi *GulliverPIR) Recover(i uint64, batchIndex uint64, offline Msg, query Msg, answer Msg,
-	shared State, client State, p Params, info DBinfo) uint64 {
+	shared State, client State, p Params, info DBinfo) (uint64, error) {
+	vals, err := pi.recoverVals(i, offline, query, answer, client, p, info)
+	if err != nil {
+		return 0, err
+	}
+	return ReconstructElem(vals, i, info), nil
+}
+
+// RecoverBytes is like Recover for databases built by NewDatabaseFromBytes.
+func (pi *GulliverPIR) RecoverBytes(i uint64, batchIndex uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) ([]byte, error) {
+	vals, err := pi.recoverVals(i, offline, query, answer, client, p, info)
+	if err != nil {
+		return nil, err
+	}
+	return ReconstructBytes(vals, i, info), nil
+}
+
+// recoverVals returns the Z_p elements that represent entry i.
+func (pi *GulliverPIR) recoverVals(i uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) ([]uint64, error) {
+	if i >= info.Num {
+		return nil, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, info.Num)
+	}
+	row, _ := info.entryPosition(i, p.M)
+	return pi.decodeRows(row, row+1, offline, query, answer, client, p, info)
+}
+
+// RecoverColumn reconstructs every entry stored in the same column as entry
+// i, which the answer to a query for i encodes in full. The values are
+// returned in the order given by ColumnIndices.
+func (pi *GulliverPIR) RecoverColumn(i uint64, offline Msg, query Msg, answer Msg,
+	shared State, client State, p Params, info DBinfo) ([]uint64, error) {
+	if i >= info.Num {
+		return nil, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, info.Num)
+	}
+	_, col := info.entryPosition(i, p.M)
+	vals, err := pi.decodeRows(0, p.L/info.Ne, offline, query, answer, client, p, info)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := ColumnIndices(col, p, info)
+	out := make([]uint64, len(indices))
+	for k, index := range indices {
+		row, _ := info.entryPosition(index, p.M)
+		elem := append([]uint64(nil), vals[row*info.Ne:(row+1)*info.Ne]...)
+		out[k] = ReconstructElem(elem, index, info)
+	}
+	return out, nil
+}
+
+// decodeRows removes the hint term from the answer and returns the Z_p
+// elements of row groups from, ..., to-1 in the queried column.
+func (pi *GulliverPIR) decodeRows(from, to uint64, offline Msg, query Msg, answer Msg,
+	client State, p Params, info DBinfo) ([]uint64, error) {
+	for _, c := range []struct {
+		data []*Matrix
+		what string
+	}{{client.Data, "client state"}, {offline.Data, "hint"}, {query.Data, "query"}, {answer.Data, "answer"}} {
+		if err := checkMsg(c.data, 1, c.what); err != nil {
+			return nil, err
+		}
+	}
 	secret := client.Data[0]
 	H := offline.Data[0]
 	ans := answer.Data[0]
-	row := i / p.M
 
-	// Calculate the offset for the query element.
-	ratio := p.P / 2
+	if query.Data[0].Rows < p.M || ans.Rows < to*info.Ne {
+		return nil, fmt.Errorf("%w: query or answer too short", ErrDimensionMismatch)
+	}
+	if H.Rows != ans.Rows || secret.Rows != H.Cols || secret.Cols != 1 {
+		return nil, dimensionError(H, secret)
+	}
+
+	// Queries built by QueryPrecomputed carry H·s and the offset.
+	var interm *Matrix
 	var offset uint64
-	for j := uint64(0); j < p.M; j++ {
-		offset += ratio * query.Data[0].Get(j, 0)
+	if len(client.Data) >= 3 {
+		if client.Data[1].Rows != H.Rows || client.Data[2].Size() != 1 {
+			return nil, fmt.Errorf("%w: precomputed client state does not match hint", ErrMalformedMsg)
+		}
+		interm, offset = client.Data[1], client.Data[2].Get(0, 0)
+	} else {
+		interm, offset = MatrixMul(H, secret), queryOffset(query.Data[0], p)
 	}
-	offset %= (1 << p.Logq)
-	offset = (1 << p.Logq) - offset
 
-	interm := MatrixMul(H, secret)
 	var vals []uint64
-	for j := row * info.Ne; j < (row+1)*info.Ne; j++ {
-		item0 := float64(interm.Data[j]) * p.deltah()
-		item1 := float64(ans.Data[j]+C.Elem(offset)) * p.deltaa()
-		denoised := uint64(math.Round(item1-item0)) % p.P
-		vals = append(vals, denoised)
+	for j := from * info.Ne; j < to*info.Ne; j++ {
+		vals = append(vals, denoise(interm.Get(j, 0), ans.Get(j, 0), offset, p))
 	}
-	return ReconstructElem(vals, i, info)
+	return vals, nil
+}
+
+// Precompute samples the index-independent material of one query: the
+// secret s, the rounded query round(A·s·q/Q) before the unit vector is added,
+// H·s, and the share of the query offset contributed by the rounded query.
+// It can run while the client is idle; QueryPrecomputed consumes the result.
+func (pi *GulliverPIR) Precompute(offline Msg, shared State, p Params, info DBinfo) (State, error) {
+	if info.Squishing == 0 {
+		return State{}, fmt.Errorf("%w: database info is missing compression settings", ErrInvalidParams)
+	}
+	if err := checkMsg(shared.Data, 1, "shared state"); err != nil {
+		return State{}, err
+	}
+	if err := checkMsg(offline.Data, 1, "hint"); err != nil {
+		return State{}, err
+	}
+	A, H := shared.Data[0], offline.Data[0]
+	if A.Rows != p.M || A.Cols != p.N || H.Cols != p.N {
+		return State{}, fmt.Errorf("%w: shared state or hint does not match params", ErrDimensionMismatch)
+	}
+
+	secret, base := lwrQueryBase(A, p, info.Squishing)
+	Hs := MatrixMul(H, secret)
+	offset := MatrixNewWidth(1, 1, p.wide())
+	offset.Set(queryOffset(base, p), 0, 0)
+	return MakeState(secret, base, Hs, offset), nil
+}
+
+// QueryPrecomputed builds the query for index i from material returned by
+// Precompute, which must not be reused. Only the unit vector is added here;
+// Recover then needs no matrix multiplication.
+func (pi *GulliverPIR) QueryPrecomputed(i uint64, pre State, p Params, info DBinfo) (State, Msg, error) {
+	if i >= info.Num {
+		return State{}, Msg{}, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, i, info.Num)
+	}
+	if err := checkMsg(pre.Data, 4, "precomputed state"); err != nil {
+		return State{}, Msg{}, err
+	}
+	secret, base, Hs, baseOffset := pre.Data[0], pre.Data[1], pre.Data[2], pre.Data[3]
+	if base.Rows < p.M || baseOffset.Size() != 1 {
+		return State{}, Msg{}, fmt.Errorf("%w: precomputed state does not match params", ErrMalformedMsg)
+	}
+
+	query := base.RowsDeepCopy(0, base.Rows)
+	_, col := info.entryPosition(i, p.M)
+	query.AddAt(p.deltai(), col, 0)
+
+	// The unit vector adds (p/2)·(q/p) to the sum in queryOffset.
+	offset := MatrixNewWidth(1, 1, p.wide())
+	offset.Set(lowBits(baseOffset.Get(0, 0)-(p.P/2)*p.deltai(), p.Logq), 0, 0)
+	return MakeState(secret, Hs, offset), MakeMsg(query), nil
+}
+
+// HintSize returns the size in KB of the hint that Setup would produce for
+// a database described by info, without building it.
+func (pi *GulliverPIR) HintSize(p Params, info DBinfo) float64 {
+	return calculateCommunicationSize(p.L*p.N, p.LogQ)
+}
+
+// OfflineSize returns the size of the hint in KB; its entries live in Z_Q.
+func (pi *GulliverPIR) OfflineSize(offline Msg, p Params) float64 {
+	return calculateCommunicationSize(offline.Size(), p.LogQ)
+}
+
+// QuerySize returns the size of a query in KB; its entries live in Z_q.
+func (pi *GulliverPIR) QuerySize(query Msg, p Params) float64 {
+	return calculateCommunicationSize(query.Size(), p.Logq)
 }
 
-// Reset resets the database to its original state.
-func (pi *GulliverPIR) Reset(DB *Database, p Params) {
-	DB.Unsquish()
-	DB.Data.Sub(p.P / 2)
+// AnswerSize returns the size of an answer in KB; its entries live in Z_q.
+func (pi *GulliverPIR) AnswerSize(answer Msg, p Params) float64 {
+	return calculateCommunicationSize(answer.Size(), p.Logq)
 }
@@ -0,0 +1,272 @@
+package pir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Keyword PIR places key/value pairs into a cuckoo hash table and serves the
+// table as an index-based database. Every key may live in one of
+// len(Seeds) slots; a client queries all of them, so every lookup costs the
+// same number of queries whether or not the key is present. Each slot holds
+// a record tag<<ValueBits | value, where the tag is a non-zero hash of the key
+// and empty slots are zero, so a missing key is detected rather than decoded
+// as garbage (up to a false-positive rate of len(Seeds)*2^-TagBits).
+
+const (
+	keywordHashes   = 3
+	keywordLoad     = 0.8
+	keywordMaxKicks = 500
+	keywordRetries  = 16
+)
+
+// KeywordParams are the public parameters of the keyword layer: the size of
+// the cuckoo table, the seeds of its hash functions and the record layout.
+type KeywordParams struct {
+	Slots     uint64
+	Seeds     []uint64
+	TagSeed   uint64
+	TagBits   uint64
+	ValueBits uint64
+}
+
+// RecordBits returns the width of every slot, i.e. the row length of the
+// underlying database.
+func (kp *KeywordParams) RecordBits() uint64 {
+	return kp.TagBits + kp.ValueBits
+}
+
+func keywordHash(seed uint64, key string) uint64 {
+	var s [8]byte
+	binary.LittleEndian.PutUint64(s[:], seed)
+	h := sha256.New()
+	h.Write(s[:])
+	io.WriteString(h, key)
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// Candidates returns the slots that may hold key, one per hash function.
+func (kp *KeywordParams) Candidates(key string) []uint64 {
+	out := make([]uint64, len(kp.Seeds))
+	for j, seed := range kp.Seeds {
+		out[j] = keywordHash(seed, key) % kp.Slots
+	}
+	return out
+}
+
+func (kp *KeywordParams) tag(key string) uint64 {
+	tag := keywordHash(kp.TagSeed, key) & (uint64(1<<kp.TagBits) - 1)
+	if tag == 0 {
+		tag = 1
+	}
+	return tag
+}
+
+// Match returns the value stored in record if the record belongs to key.
+func (kp *KeywordParams) Match(key string, record uint64) (uint64, bool) {
+	if record>>kp.ValueBits != kp.tag(key) {
+		return 0, false
+	}
+	return record & (uint64(1<<kp.ValueBits) - 1), true
+}
+
+const keywordParamsMagic = "GPIRKW01"
+
+// MarshalBinary encodes the keyword parameters as little-endian integers.
+func (kp *KeywordParams) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(keywordParamsMagic)
+	for _, v := range []uint64{kp.Slots, kp.TagSeed, kp.TagBits, kp.ValueBits, uint64(len(kp.Seeds))} {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	binary.Write(&buf, binary.LittleEndian, kp.Seeds)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes keyword parameters encoded by MarshalBinary.
+func (kp *KeywordParams) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(keywordParamsMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != keywordParamsMagic {
+		return fmt.Errorf("%w: not an encoding of keyword parameters", ErrMalformedMsg)
+	}
+	var hdr [5]uint64
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("%w: truncated keyword parameters", ErrMalformedMsg)
+	}
+	if hdr[4] == 0 || hdr[4] != uint64(r.Len())/8 || r.Len()%8 != 0 {
+		return fmt.Errorf("%w: bad number of hash seeds", ErrMalformedMsg)
+	}
+	out := KeywordParams{Slots: hdr[0], TagSeed: hdr[1], TagBits: hdr[2], ValueBits: hdr[3], Seeds: make([]uint64, hdr[4])}
+	binary.Read(r, binary.LittleEndian, out.Seeds)
+	if err := out.validate(); err != nil {
+		return err
+	}
+	*kp = out
+	return nil
+}
+
+func (kp *KeywordParams) validate() error {
+	if kp.Slots == 0 || kp.TagBits == 0 || kp.ValueBits == 0 || kp.RecordBits() > 64 {
+		return fmt.Errorf("%w: %d slots of %d tag bits and %d value bits",
+			ErrInvalidParams, kp.Slots, kp.TagBits, kp.ValueBits)
+	}
+	return nil
+}
+
+// KeywordTable is the server-side cuckoo table of a keyword database.
+type KeywordTable struct {
+	Params KeywordParams
+	slots  []uint64
+}
+
+// NewKeywordTable places the pairs into a cuckoo table whose records hold a
+// tagBits-bit tag and a valueBits-bit value. If the insertion fails, the hash
+// functions are resampled and the table is rebuilt.
+func NewKeywordTable(pairs map[string]uint64, valueBits, tagBits uint64) (*KeywordTable, error) {
+	t := new(KeywordTable)
+	t.Params = KeywordParams{
+		Slots:     uint64(math.Ceil(float64(len(pairs))/keywordLoad)) + keywordHashes,
+		TagBits:   tagBits,
+		ValueBits: valueBits,
+	}
+	if err := t.Params.validate(); err != nil {
+		return nil, err
+	}
+	for key, val := range pairs {
+		if val>>valueBits != 0 {
+			return nil, fmt.Errorf("%w: value %d of key %q exceeds %d bits", ErrInvalidParams, val, key, valueBits)
+		}
+	}
+
+	rng := MathRand()
+	for attempt := 0; attempt < keywordRetries; attempt++ {
+		t.Params.TagSeed = rng.Uint64()
+		t.Params.Seeds = make([]uint64, keywordHashes)
+		for j := range t.Params.Seeds {
+			t.Params.Seeds[j] = rng.Uint64()
+		}
+		if t.build(pairs) {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: cuckoo insertion failed after %d attempts", ErrInvalidParams, keywordRetries)
+}
+
+// build inserts all pairs with the current hash functions, evicting a random
+// occupant whenever all candidate slots are full.
+func (t *KeywordTable) build(pairs map[string]uint64) bool {
+	rng := MathRand()
+	t.slots = make([]uint64, t.Params.Slots)
+	keys := make([]string, t.Params.Slots)
+	for key, val := range pairs {
+		curKey, cur := key, t.Params.tag(key)<<t.Params.ValueBits|val
+		placed := false
+		for kick := 0; kick < keywordMaxKicks && !placed; kick++ {
+			cands := t.Params.Candidates(curKey)
+			for _, c := range cands {
+				if t.slots[c] == 0 {
+					t.slots[c], keys[c] = cur, curKey
+					placed = true
+					break
+				}
+			}
+			if !placed {
+				c := cands[rng.Intn(len(cands))]
+				t.slots[c], cur = cur, t.slots[c]
+				keys[c], curKey = curKey, keys[c]
+			}
+		}
+		if !placed {
+			return false
+		}
+	}
+	return true
+}
+
+// Database builds the index-based database holding the table's slots.
+func (t *KeywordTable) Database(p *Params) (*Database, error) {
+	return NewDatabaseFromValues(t.Params.Slots, t.Params.RecordBits(), p, t.slots)
+}
+
+// KeywordHandle identifies a keyword lookup issued by a KeywordClient.
+type KeywordHandle struct {
+	key     string
+	handles []QueryHandle
+}
+
+// KeywordClient looks up keys privately through a Client.
+type KeywordClient struct {
+	client *Client
+	params KeywordParams
+}
+
+// NewKeywordClient wraps client, which must query the database built by
+// KeywordTable.Database, with the encoded keyword parameters of its table.
+func NewKeywordClient(client *Client, params []byte) (*KeywordClient, error) {
+	kc := &KeywordClient{client: client}
+	if err := kc.params.UnmarshalBinary(params); err != nil {
+		return nil, err
+	}
+	if kc.params.Slots != client.NumRecords() {
+		return nil, fmt.Errorf("%w: table has %d slots but database has %d records",
+			ErrInvalidParams, kc.params.Slots, client.NumRecords())
+	}
+	return kc, nil
+}
+
+// Query builds one encoded query per candidate slot of key. The number of
+// queries is the same for every key.
+func (kc *KeywordClient) Query(key string) (KeywordHandle, [][]byte, error) {
+	h := KeywordHandle{key: key}
+	var queries [][]byte
+	for _, slot := range kc.params.Candidates(key) {
+		qh, q, err := kc.client.Query(slot)
+		if err != nil {
+			for _, qh := range h.handles {
+				kc.client.Cancel(qh)
+			}
+			return KeywordHandle{}, nil, err
+		}
+		h.handles = append(h.handles, qh)
+		queries = append(queries, q)
+	}
+	return h, queries, nil
+}
+
+// Recover decodes the answers to the queries of h, in order, and returns the
+// value of the key, or ErrNotFound if none of its slots holds it.
+func (kc *KeywordClient) Recover(h KeywordHandle, answers [][]byte) (uint64, error) {
+	if len(answers) != len(h.handles) {
+		for _, qh := range h.handles {
+			kc.client.Cancel(qh)
+		}
+		return 0, fmt.Errorf("%w: got %d answers for %d queries", ErrMalformedMsg, len(answers), len(h.handles))
+	}
+	var val uint64
+	found := false
+	var firstErr error
+	for j, qh := range h.handles {
+		record, err := kc.client.Recover(qh, answers[j])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if v, ok := kc.params.Match(h.key, record); ok && !found {
+			val, found = v, true
+		}
+	}
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	if !found {
+		return 0, fmt.Errorf("%w: %q", ErrNotFound, h.key)
+	}
+	return val, nil
+}
@@ -0,0 +1,214 @@
+package pir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// RecordFormat selects how LoadDatabase splits its input into records.
+type RecordFormat int
+
+const (
+	// FormatFixedWidth reads consecutive records of LoadOptions.RecordLen
+	// bytes each. The input size must be a multiple of the record length.
+	FormatFixedWidth RecordFormat = iota
+	// FormatCSV reads one unsigned integer per CSV row, from column
+	// LoadOptions.Column. Values may be decimal or carry a 0x, 0o or 0b
+	// prefix. The row length is the bit length of the largest value.
+	FormatCSV
+	// FormatLines reads one record per line, without the line terminator.
+	// Shorter lines are padded with zero bytes to the longest line, so
+	// lines should not end in zero bytes themselves.
+	FormatLines
+)
+
+// LoadOptions configure LoadDatabase and ScanRecords.
+type LoadOptions struct {
+	Format    RecordFormat
+	RecordLen uint64 // record length in bytes, for FormatFixedWidth
+	Column    int    // zero-based column to read, for FormatCSV
+	Header    bool   // whether the first CSV row is a header to skip
+}
+
+// ScanRecords reads r once and returns the number of records it holds and
+// their length in bits, e.g. to pick Params before calling LoadDatabase. It
+// leaves r at an unspecified position.
+func ScanRecords(r io.ReadSeeker, opt LoadOptions) (num, rowLength uint64, err error) {
+	if opt.Format == FormatFixedWidth {
+		if opt.RecordLen == 0 {
+			return 0, 0, fmt.Errorf("%w: record length must be positive", ErrInvalidParams)
+		}
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uint64(size)%opt.RecordLen != 0 {
+			return 0, 0, fmt.Errorf("%w: input of %d bytes is not a multiple of %d-byte records",
+				ErrMalformedRecords, size, opt.RecordLen)
+		}
+		return uint64(size) / opt.RecordLen, 8 * opt.RecordLen, nil
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	err = eachRecord(r, opt, func(rec []byte) error {
+		num++
+		if opt.Format == FormatCSV {
+			rowLength = max64(rowLength, uint64(bits.Len64(binary.BigEndian.Uint64(rec))))
+		} else {
+			rowLength = max64(rowLength, 8*uint64(len(rec)))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if rowLength == 0 && num > 0 {
+		// All records are empty or zero; they still need one bit.
+		rowLength = 1
+		if opt.Format == FormatLines {
+			rowLength = 8
+		}
+	}
+	return num, rowLength, nil
+}
+
+// LoadDatabase builds a database from the records in r. It infers the number
+// of records and their length with ScanRecords, validates them against p
+// and then streams the records into the database matrix in a second pass,
+// so that the input is never held in memory as a whole.
+func LoadDatabase(r io.ReadSeeker, p *Params, opt LoadOptions) (*Database, error) {
+	num, rowLength, err := ScanRecords(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewDBBuilder(num, rowLength, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	recLen := int((rowLength + 7) / 8)
+	padded := make([]byte, recLen)
+	err = eachRecord(r, opt, func(rec []byte) error {
+		if b.Added() >= num {
+			return fmt.Errorf("%w: input grew while loading", ErrMalformedRecords)
+		}
+		if opt.Format == FormatLines {
+			// Pad with zeros on the right, keeping the line as a prefix.
+			copy(padded, rec)
+			for j := len(rec); j < recLen; j++ {
+				padded[j] = 0
+			}
+			rec = padded
+		}
+		return b.AddBytes(rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b.Added() != num {
+		return nil, fmt.Errorf("%w: input shrank while loading", ErrMalformedRecords)
+	}
+	return b.Finish()
+}
+
+// eachRecord calls f with every record of r, starting at its current
+// position. CSV values are passed as 8 big-endian bytes. The slice passed to
+// f is only valid until f returns.
+func eachRecord(r io.Reader, opt LoadOptions, f func(rec []byte) error) error {
+	switch opt.Format {
+	case FormatFixedWidth:
+		rec := make([]byte, opt.RecordLen)
+		br := bufio.NewReader(r)
+		for {
+			if _, err := io.ReadFull(br, rec); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("%w: truncated record: %v", ErrMalformedRecords, err)
+			}
+			if err := f(rec); err != nil {
+				return err
+			}
+		}
+
+	case FormatCSV:
+		if opt.Column < 0 {
+			return fmt.Errorf("%w: column %d", ErrInvalidParams, opt.Column)
+		}
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		var rec [8]byte
+		for row := 0; ; row++ {
+			fields, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("%w: %v", ErrMalformedRecords, err)
+			}
+			if row == 0 && opt.Header {
+				continue
+			}
+			if opt.Column >= len(fields) {
+				return fmt.Errorf("%w: row %d has no column %d", ErrMalformedRecords, row, opt.Column)
+			}
+			v, err := strconv.ParseUint(strings.TrimSpace(fields[opt.Column]), 0, 64)
+			if err != nil {
+				return fmt.Errorf("%w: row %d: %v", ErrMalformedRecords, row, err)
+			}
+			binary.BigEndian.PutUint64(rec[:], v)
+			if err := f(rec[:]); err != nil {
+				return err
+			}
+		}
+
+	case FormatLines:
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				// Long line: collect it in full.
+				var buf bytes.Buffer
+				buf.Write(line)
+				for err == bufio.ErrBufferFull {
+					line, err = br.ReadSlice('\n')
+					buf.Write(line)
+				}
+				line = buf.Bytes()
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			if len(line) == 0 && err != nil {
+				return nil
+			}
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if ferr := f(line); ferr != nil {
+				return ferr
+			}
+			if err != nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: unknown record format %d", ErrInvalidParams, opt.Format)
+}
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,14 +2,39 @@ package pir
 
 import (
 	"fmt"
+	"io"
 	"math"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
+// logOutput holds the writer that receives the progress messages of the
+// package, such as the parameters picked by PickParams.
+var logOutput atomic.Value
+
+func init() {
+	SetLogOutput(os.Stdout)
+}
+
+// SetLogOutput sends the progress messages of the package to w, or drops
+// them if w is nil. They go to os.Stdout by default.
+func SetLogOutput(w io.Writer) {
+	if w == nil {
+		w = io.Discard
+	}
+	logOutput.Store(&w)
+}
+
+// logf writes a progress message to the writer set by SetLogOutput.
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(*logOutput.Load().(*io.Writer), format, args...)
+}
+
 // Helper function to print the elapsed time since start.
 func printTime(start time.Time) time.Duration {
 	elapsed := time.Since(start)
-	fmt.Printf("\tElapsed: %s\n", elapsed)
+	logf("\tElapsed: %s\n", elapsed)
 	return elapsed
 }
 
@@ -17,7 +42,7 @@ func printTime(start time.Time) time.Duration {
 func printRate(p Params, elapsed time.Duration, batch_sz int) float64 {
 	rate := math.Log2(float64((p.P))) * float64(p.L*p.M) * float64(batch_sz) /
 		float64(8*1024*1024*elapsed.Seconds())
-	fmt.Printf("\tRate: %f MB/s\n", rate)
+	logf("\tRate: %f MB/s\n", rate)
 	return rate
 }
 
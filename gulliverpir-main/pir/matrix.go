@@ -8,10 +8,16 @@ import (
 	"math/big"
 )
 
+// Matrix is a matrix over Z_2^32, or over Z_2^64 if it is wide. A wide
+// matrix keeps its entries in Data64 and leaves Data empty; all operations
+// on two matrices require them to have the same width.
 type Matrix struct {
 	Rows uint64
 	Cols uint64
 	Data []C.Elem
+
+	Wide   bool
+	Data64 []C.Elem64
 }
 
 func (m *Matrix) Size() uint64 {
@@ -19,7 +25,7 @@ func (m *Matrix) Size() uint64 {
 }
 
 func (m *Matrix) AppendZeros(n uint64) {
-	m.Concat(MatrixZeros(n, 1))
+	m.Concat(MatrixNewWidth(n, 1, m.Wide))
 }
 
 func MatrixNew(rows uint64, cols uint64) *Matrix {
@@ -30,6 +36,24 @@ func MatrixNew(rows uint64, cols uint64) *Matrix {
 	return out
 }
 
+// MatrixNew64 allocates a wide matrix of zeros.
+func MatrixNew64(rows uint64, cols uint64) *Matrix {
+	out := new(Matrix)
+	out.Rows = rows
+	out.Cols = cols
+	out.Wide = true
+	out.Data64 = make([]C.Elem64, rows*cols)
+	return out
+}
+
+// MatrixNewWidth allocates a matrix of zeros that is wide if wide is set.
+func MatrixNewWidth(rows uint64, cols uint64, wide bool) *Matrix {
+	if wide {
+		return MatrixNew64(rows, cols)
+	}
+	return MatrixNew(rows, cols)
+}
+
 func MatrixNewNoAlloc(rows uint64, cols uint64) *Matrix {
 	out := new(Matrix)
 	out.Rows = rows
@@ -39,12 +63,49 @@ func MatrixNewNoAlloc(rows uint64, cols uint64) *Matrix {
 
 func MatrixRand(rows uint64, cols uint64, logmod uint64, mod uint64) *Matrix {
 	out := MatrixNew(rows, cols)
-	m := big.NewInt(int64(mod))
+	m := randModulus(logmod, mod)
+	for i := 0; i < len(out.Data); i++ {
+		out.Data[i] = C.Elem(RandInt(m).Uint64())
+	}
+	return out
+}
+
+// randModulus returns mod, or 2^logmod if mod is zero, as a big.Int.
+func randModulus(logmod uint64, mod uint64) *big.Int {
 	if mod == 0 {
-		m = big.NewInt(1 << logmod)
+		return new(big.Int).Lsh(big.NewInt(1), uint(logmod))
 	}
+	return new(big.Int).SetUint64(mod)
+}
+
+// MatrixRand64 is like MatrixRand, but returns a wide matrix.
+func MatrixRand64(rows uint64, cols uint64, logmod uint64, mod uint64) *Matrix {
+	out := MatrixNew64(rows, cols)
+	m := randModulus(logmod, mod)
+	for i := 0; i < len(out.Data64); i++ {
+		out.Data64[i] = C.Elem64(RandInt(m).Uint64())
+	}
+	return out
+}
+
+// MatrixRandPRG samples a matrix like MatrixRand, but draws the entries from
+// the given PRG instead of the global one. Two readers built from the same
+// PRGKey therefore produce the same matrix.
+func MatrixRandPRG(prg *BufPRGReader, rows uint64, cols uint64, logmod uint64, mod uint64) *Matrix {
+	out := MatrixNew(rows, cols)
+	m := randModulus(logmod, mod)
 	for i := 0; i < len(out.Data); i++ {
-		out.Data[i] = C.Elem(RandInt(m).Uint64())
+		out.Data[i] = C.Elem(prg.RandInt(m).Uint64())
+	}
+	return out
+}
+
+// MatrixRandPRG64 is like MatrixRandPRG, but returns a wide matrix.
+func MatrixRandPRG64(prg *BufPRGReader, rows uint64, cols uint64, logmod uint64, mod uint64) *Matrix {
+	out := MatrixNew64(rows, cols)
+	m := randModulus(logmod, mod)
+	for i := 0; i < len(out.Data64); i++ {
+		out.Data64[i] = C.Elem64(prg.RandInt(m).Uint64())
 	}
 	return out
 }
@@ -58,36 +119,56 @@ func MatrixZeros(rows uint64, cols uint64) *Matrix {
 }
 
 func (m *Matrix) ReduceMod(p uint64) {
+	if m.Wide {
+		for i := range m.Data64 {
+			m.Data64[i] %= C.Elem64(p)
+		}
+		return
+	}
 	mod := C.Elem(p)
 	for i := 0; i < len(m.Data); i++ {
 		m.Data[i] = m.Data[i] % mod
 	}
 }
 
+// CheckIndex reports whether (i, j) lies inside the matrix.
+func (m *Matrix) CheckIndex(i, j uint64) error {
+	if i >= m.Rows || j >= m.Cols {
+		return fmt.Errorf("%w: (%d, %d) in %d-by-%d matrix", ErrIndexOutOfRange, i, j, m.Rows, m.Cols)
+	}
+	return nil
+}
+
 func (m *Matrix) Get(i, j uint64) uint64 {
-	if i >= m.Rows {
-		panic("Too many rows!")
+	if err := m.CheckIndex(i, j); err != nil {
+		panic(err)
 	}
-	if j >= m.Cols {
-		panic("Too many cols!")
+	if m.Wide {
+		return uint64(m.Data64[i*m.Cols+j])
 	}
 	return uint64(m.Data[i*m.Cols+j])
 }
 
 func (m *Matrix) Set(val, i, j uint64) {
-	if i >= m.Rows {
-		panic("Too many rows!")
+	if err := m.CheckIndex(i, j); err != nil {
+		panic(err)
 	}
-	if j >= m.Cols {
-		panic("Too many cols!")
+	if m.Wide {
+		m.Data64[i*m.Cols+j] = C.Elem64(val)
+		return
 	}
 	m.Data[i*m.Cols+j] = C.Elem(val)
 }
 
 func (a *Matrix) MatrixAdd(b *Matrix) {
-	if (a.Cols != b.Cols) || (a.Rows != b.Rows) {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
-		panic("Dimension mismatch")
+	if (a.Cols != b.Cols) || (a.Rows != b.Rows) || a.Wide != b.Wide {
+		panic(dimensionError(a, b))
+	}
+	if a.Wide {
+		for i := range a.Data64 {
+			a.Data64[i] += b.Data64[i]
+		}
+		return
 	}
 	for i := uint64(0); i < a.Cols*a.Rows; i++ {
 		a.Data[i] += b.Data[i]
@@ -95,6 +176,12 @@ func (a *Matrix) MatrixAdd(b *Matrix) {
 }
 
 func (a *Matrix) Add(val uint64) {
+	if a.Wide {
+		for i := range a.Data64 {
+			a.Data64[i] += C.Elem64(val)
+		}
+		return
+	}
 	v := C.Elem(val)
 	for i := uint64(0); i < a.Cols*a.Rows; i++ {
 		a.Data[i] += v
@@ -102,16 +189,21 @@ func (a *Matrix) Add(val uint64) {
 }
 
 func (a *Matrix) AddAt(val, i, j uint64) {
-	if (i >= a.Rows) || (j >= a.Cols) {
-		panic("Out of bounds")
+	if err := a.CheckIndex(i, j); err != nil {
+		panic(err)
 	}
 	a.Set(a.Get(i, j)+val, i, j)
 }
 
 func (a *Matrix) MatrixSub(b *Matrix) {
-	if (a.Cols != b.Cols) || (a.Rows != b.Rows) {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
-		panic("Dimension mismatch")
+	if (a.Cols != b.Cols) || (a.Rows != b.Rows) || a.Wide != b.Wide {
+		panic(dimensionError(a, b))
+	}
+	if a.Wide {
+		for i := range a.Data64 {
+			a.Data64[i] -= b.Data64[i]
+		}
+		return
 	}
 	for i := uint64(0); i < a.Cols*a.Rows; i++ {
 		a.Data[i] -= b.Data[i]
@@ -119,19 +211,42 @@ func (a *Matrix) MatrixSub(b *Matrix) {
 }
 
 func (a *Matrix) Sub(val uint64) {
+	if a.Wide {
+		for i := range a.Data64 {
+			a.Data64[i] -= C.Elem64(val)
+		}
+		return
+	}
 	v := C.Elem(val)
 	for i := uint64(0); i < a.Cols*a.Rows; i++ {
 		a.Data[i] -= v
 	}
 }
 
+// CheckMatrixMul reports whether MatrixMul(a, b) is well defined.
+func CheckMatrixMul(a *Matrix, b *Matrix) error {
+	if b.Cols == 1 {
+		return CheckMatrixMulVec(a, b)
+	}
+	if a.Cols != b.Rows || a.Rows == 0 || b.Cols == 0 || a.Wide != b.Wide {
+		return dimensionError(a, b)
+	}
+	return nil
+}
+
 func MatrixMul(a *Matrix, b *Matrix) *Matrix {
 	if b.Cols == 1 {
 		return MatrixMulVec(a, b)
 	}
-	if a.Cols != b.Rows {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
-		panic("Dimension mismatch")
+	if err := CheckMatrixMul(a, b); err != nil {
+		panic(err)
+	}
+
+	if a.Wide {
+		out := MatrixNew64(a.Rows, b.Cols)
+		C.matMul64(&out.Data64[0], &a.Data64[0], &b.Data64[0],
+			C.size_t(a.Rows), C.size_t(a.Cols), C.size_t(b.Cols))
+		return out
 	}
 
 	out := MatrixZeros(a.Rows, b.Cols)
@@ -149,7 +264,6 @@ func MatrixMul(a *Matrix, b *Matrix) *Matrix {
 }
 
 func MatrixMulTransposedPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix {
-	fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Cols, b.Rows)
 	if compression != 3 && basis != 10 {
 		panic("Must use hard-coded values!")
 	}
@@ -169,13 +283,29 @@ func MatrixMulTransposedPacked(a *Matrix, b *Matrix, basis, compression uint64)
 	return out
 }
 
-func MatrixMulVec(a *Matrix, b *Matrix) *Matrix {
+// CheckMatrixMulVec reports whether MatrixMulVec(a, b) is well defined.
+func CheckMatrixMulVec(a *Matrix, b *Matrix) error {
 	if (a.Cols != b.Rows) && (a.Cols+1 != b.Rows) && (a.Cols+2 != b.Rows) { // do not require exact match because of DB compression
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
-		panic("Dimension mismatch")
+		return dimensionError(a, b)
 	}
 	if b.Cols != 1 {
-		panic("Second argument is not a vector")
+		return fmt.Errorf("%w: second argument is not a vector", ErrDimensionMismatch)
+	}
+	if a.Rows == 0 || a.Cols == 0 || a.Wide != b.Wide {
+		return dimensionError(a, b)
+	}
+	return nil
+}
+
+func MatrixMulVec(a *Matrix, b *Matrix) *Matrix {
+	if err := CheckMatrixMulVec(a, b); err != nil {
+		panic(err)
+	}
+
+	if a.Wide {
+		out := MatrixNew64(a.Rows, 1)
+		C.matMulVec64(&out.Data64[0], &a.Data64[0], &b.Data64[0], C.size_t(a.Rows), C.size_t(a.Cols))
+		return out
 	}
 
 	out := MatrixNew(a.Rows, 1)
@@ -191,16 +321,66 @@ func MatrixMulVec(a *Matrix, b *Matrix) *Matrix {
 	return out
 }
 
-func MatrixMulVecPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix {
-	if a.Cols*compression != b.Rows {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
-		panic("Dimension mismatch")
+// CheckMatrixMulPacked reports whether MatrixMulPacked(a, b, basis,
+// compression) is well defined.
+func CheckMatrixMulPacked(a *Matrix, b *Matrix, basis, compression uint64) error {
+	wantBasis, wantCompression := squishSettings(a.Wide)
+	if compression != wantCompression || basis != wantBasis {
+		return fmt.Errorf("%w: packed kernels require basis %d and compression %d, got %d and %d",
+			ErrInvalidParams, wantBasis, wantCompression, basis, compression)
+	}
+	if a.Cols*compression != b.Rows || a.Cols == 0 || b.Cols == 0 || a.Wide != b.Wide {
+		return dimensionError(a, b)
+	}
+	return nil
+}
+
+// CheckMatrixMulVecPacked reports whether MatrixMulVecPacked(a, b, basis,
+// compression) is well defined.
+func CheckMatrixMulVecPacked(a *Matrix, b *Matrix, basis, compression uint64) error {
+	if err := CheckMatrixMulPacked(a, b, basis, compression); err != nil {
+		return err
 	}
 	if b.Cols != 1 {
-		panic("Second argument is not a vector")
+		return fmt.Errorf("%w: second argument is not a vector", ErrDimensionMismatch)
 	}
-	if compression != 3 && basis != 10 {
-		panic("Must use hard-coded values!")
+	return nil
+}
+
+// MatrixMulPacked multiplies the squished matrix a by the unsquished matrix b,
+// whose columns are typically a batch of stacked queries.
+func MatrixMulPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix {
+	if err := CheckMatrixMulPacked(a, b, basis, compression); err != nil {
+		panic(err)
+	}
+
+	if a.Wide {
+		out := MatrixNew64(a.Rows, b.Cols)
+		C.matMulPacked64(&out.Data64[0], &a.Data64[0], &b.Data64[0],
+			C.size_t(a.Rows), C.size_t(a.Cols), C.size_t(b.Cols))
+		return out
+	}
+
+	out := MatrixNew(a.Rows, b.Cols)
+
+	outPtr := (*C.Elem)(&out.Data[0])
+	aPtr := (*C.Elem)(&a.Data[0])
+	bPtr := (*C.Elem)(&b.Data[0])
+
+	C.matMulPacked(outPtr, aPtr, bPtr, C.size_t(a.Rows), C.size_t(a.Cols), C.size_t(b.Cols))
+
+	return out
+}
+
+func MatrixMulVecPacked(a *Matrix, b *Matrix, basis, compression uint64) *Matrix {
+	if err := CheckMatrixMulVecPacked(a, b, basis, compression); err != nil {
+		panic(err)
+	}
+
+	if a.Wide {
+		out := MatrixNew64(a.Rows, 1)
+		C.matMulVecPacked64(&out.Data64[0], &a.Data64[0], &b.Data64[0], C.size_t(a.Rows), C.size_t(a.Cols))
+		return out
 	}
 
 	out := MatrixNew(a.Rows+8, 1)
@@ -227,6 +407,17 @@ func (m *Matrix) Transpose() {
 		return
 	}
 
+	if m.Wide {
+		out := MatrixNew64(m.Cols, m.Rows)
+		for i := uint64(0); i < m.Rows; i++ {
+			for j := uint64(0); j < m.Cols; j++ {
+				out.Data64[j*m.Rows+i] = m.Data64[i*m.Cols+j]
+			}
+		}
+		*m = *out
+		return
+	}
+
 	out := MatrixNew(m.Cols, m.Rows)
 
 	outPtr := (*C.Elem)(&out.Data[0])
@@ -243,19 +434,17 @@ func (m *Matrix) Transpose() {
 
 func (a *Matrix) Concat(b *Matrix) {
 	if a.Cols == 0 && a.Rows == 0 {
-		a.Cols = b.Cols
-		a.Rows = b.Rows
-		a.Data = b.Data
+		*a = *b
 		return
 	}
 
-	if a.Cols != b.Cols {
-		fmt.Printf("%d-by-%d vs. %d-by-%d\n", a.Rows, a.Cols, b.Rows, b.Cols)
-		panic("Dimension mismatch")
+	if a.Cols != b.Cols || a.Wide != b.Wide {
+		panic(dimensionError(a, b))
 	}
 
 	a.Rows += b.Rows
 	a.Data = append(a.Data, b.Data...)
+	a.Data64 = append(a.Data64, b.Data64...)
 }
 
 // Represent each element in the database with 'delta' elements in Z_'mod'.
@@ -282,7 +471,7 @@ func (m *Matrix) Expand(mod uint64, delta uint64) {
 
 func (m *Matrix) TransposeAndExpandAndConcatColsAndSquish(mod, delta, concat, basis, d uint64) {
 	if m.Rows%concat != 0 {
-		panic("Bad input!")
+		panic(fmt.Errorf("%w: %d rows cannot be split into %d groups", ErrDimensionMismatch, m.Rows, concat))
 	}
 
 	n := MatrixZeros(m.Cols*delta*concat, (m.Rows/concat+d-1)/d)
@@ -310,6 +499,10 @@ func (m *Matrix) TransposeAndExpandAndConcatColsAndSquish(mod, delta, concat, ba
 // group of 'delta' consecutive values as a single database element,
 // where each value uses 'basis' bits.
 func (m *Matrix) Squish(basis, delta uint64) {
+	if m.Wide {
+		m.squish64(basis, delta)
+		return
+	}
 	n := MatrixZeros(m.Rows, (m.Cols+delta-1)/delta)
 
 	for i := uint64(0); i < n.Rows; i++ {
@@ -328,28 +521,43 @@ func (m *Matrix) Squish(basis, delta uint64) {
 	m.Data = n.Data
 }
 
+// squish64 is Squish for wide matrices.
+func (m *Matrix) squish64(basis, delta uint64) {
+	n := MatrixNew64(m.Rows, (m.Cols+delta-1)/delta)
+	for i := uint64(0); i < n.Rows; i++ {
+		for j := uint64(0); j < n.Cols; j++ {
+			for k := uint64(0); k < delta && delta*j+k < m.Cols; k++ {
+				n.Data64[i*n.Cols+j] += m.Data64[i*m.Cols+delta*j+k] << (k * basis)
+			}
+		}
+	}
+	*m = *n
+}
+
 // Computes the inverse operation of Squish(.)
 func (m *Matrix) Unsquish(basis, delta, cols uint64) {
-	n := MatrixZeros(m.Rows, cols)
+	n := MatrixNewWidth(m.Rows, cols, m.Wide)
 	mask := uint64((1 << basis) - 1)
 
 	for i := uint64(0); i < m.Rows; i++ {
 		for j := uint64(0); j < m.Cols; j++ {
 			for k := uint64(0); k < delta; k++ {
 				if j*delta+k < cols {
-					n.Data[i*n.Cols+j*delta+k] = C.Elem(((m.Get(i, j)) >> (k * basis)) & mask)
+					n.Set(((m.Get(i, j))>>(k*basis))&mask, i, j*delta+k)
 				}
 			}
 		}
 	}
 
-	m.Cols = n.Cols
-	m.Rows = n.Rows
-	m.Data = n.Data
+	*m = *n
 }
 
 func (m *Matrix) DropLastRows(n uint64) {
 	m.Rows -= n
+	if m.Wide {
+		m.Data64 = m.Data64[:(m.Rows * m.Cols)]
+		return
+	}
 	m.Data = m.Data[:(m.Rows * m.Cols)]
 }
 
@@ -358,9 +566,9 @@ func (m *Matrix) SelectColumn(i uint64) *Matrix {
 		return m
 	}
 
-	col := MatrixNew(m.Rows, 1)
+	col := MatrixNewWidth(m.Rows, 1, m.Wide)
 	for j := uint64(0); j < m.Rows; j++ {
-		col.Data[j] = m.Data[j*m.Cols+i]
+		col.Set(m.Get(j, i), j, 0)
 	}
 	return col
 }
@@ -371,34 +579,33 @@ func (m *Matrix) SelectRows(offset, num_rows uint64) *Matrix {
 	}
 
 	if offset > m.Rows {
-		panic("Asking for bad offset!")
+		panic(fmt.Errorf("%w: row offset %d in %d-row matrix", ErrIndexOutOfRange, offset, m.Rows))
 	}
 
-	if offset+num_rows <= m.Rows {
-		m2 := MatrixNewNoAlloc(num_rows, m.Cols)
-		m2.Data = m.Data[(offset * m.Cols) : (offset+num_rows)*m.Cols]
+	if offset+num_rows > m.Rows {
+		num_rows = m.Rows - offset
+	}
+	m2 := MatrixNewNoAlloc(num_rows, m.Cols)
+	m2.Wide = m.Wide
+	if m.Wide {
+		m2.Data64 = m.Data64[(offset * m.Cols) : (offset+num_rows)*m.Cols]
 		return m2
 	}
-
-	m2 := MatrixNewNoAlloc(m.Rows-offset, m.Cols)
-	m2.Data = m.Data[(offset * m.Cols) : (m.Rows)*m.Cols]
-
+	m2.Data = m.Data[(offset * m.Cols) : (offset+num_rows)*m.Cols]
 	return m2
 }
 
 func (m *Matrix) RowsDeepCopy(offset, num_rows uint64) *Matrix {
 	if offset+num_rows > m.Rows {
-		panic("Requesting too many rows")
+		panic(fmt.Errorf("%w: rows %d..%d in %d-row matrix", ErrIndexOutOfRange, offset, offset+num_rows, m.Rows))
 	}
 
-	if offset+num_rows <= m.Rows {
-		m2 := MatrixNew(num_rows, m.Cols)
-		copy(m2.Data, m.Data[(offset*m.Cols):((offset+num_rows)*m.Cols)])
+	m2 := MatrixNewWidth(num_rows, m.Cols, m.Wide)
+	if m.Wide {
+		copy(m2.Data64, m.Data64[(offset*m.Cols):((offset+num_rows)*m.Cols)])
 		return m2
 	}
-
-	m2 := MatrixNew(m.Rows-offset, m.Cols)
-	copy(m2.Data, m.Data[(offset*m.Cols):(m.Rows)*m.Cols])
+	copy(m2.Data, m.Data[(offset*m.Cols):((offset+num_rows)*m.Cols)])
 	return m2
 }
 
@@ -408,21 +615,19 @@ func (m *Matrix) ConcatCols(n uint64) {
 	}
 
 	if m.Cols%n != 0 {
-		panic("n does not divide num cols")
+		panic(fmt.Errorf("%w: %d does not divide %d columns", ErrDimensionMismatch, n, m.Cols))
 	}
 
-	m2 := MatrixNew(m.Rows*n, m.Cols/n)
+	m2 := MatrixNewWidth(m.Rows*n, m.Cols/n, m.Wide)
 	for i := uint64(0); i < m.Rows; i++ {
 		for j := uint64(0); j < m.Cols; j++ {
 			col := j / n
 			row := i + m.Rows*(j%n)
-			m2.Data[row*m2.Cols+col] = m.Data[i*m.Cols+j]
+			m2.Set(m.Get(i, j), row, col)
 		}
 	}
 
-	m.Cols = m2.Cols
-	m.Rows = m2.Rows
-	m.Data = m2.Data
+	*m = *m2
 }
 
 func (m *Matrix) Dim() {
@@ -433,7 +638,7 @@ func (m *Matrix) Print() {
 	fmt.Printf("%d-by-%d matrix:\n", m.Rows, m.Cols)
 	for i := uint64(0); i < m.Rows; i++ {
 		for j := uint64(0); j < m.Cols; j++ {
-			fmt.Printf("%d ", m.Data[i*m.Cols+j])
+			fmt.Printf("%d ", m.Get(i, j))
 		}
 		fmt.Printf("\n")
 	}
@@ -443,7 +648,7 @@ func (m *Matrix) PrintStart() {
 	fmt.Printf("%d-by-%d matrix:\n", m.Rows, m.Cols)
 	for i := uint64(0); i < 2; i++ {
 		for j := uint64(0); j < 2; j++ {
-			fmt.Printf("%d ", m.Data[i*m.Cols+j])
+			fmt.Printf("%d ", m.Get(i, j))
 		}
 		fmt.Printf("\n")
 	}
@@ -3,13 +3,17 @@ package pir
 import (
 	"fmt"
 	"math"
+	"strings"
 
 	_ "embed"
 )
 
 type Params struct {
 	N       uint64 // LWR secret dimension
-	Uniform uint64 // LWR secret distribution
+	Uniform uint64 // LWR secret range, for uniform secrets
+
+	Secret      SecretDist // LWR secret distribution
+	SecretParam uint64     // binomial parameter or Hamming weight of the secret
 
 	L uint64 // DB height
 	M uint64 // DB width
@@ -17,6 +21,29 @@ type Params struct {
 	LogQ uint64 // (logarithm of) hint modulus
 	Logq uint64 // (logarithm of) query modulus
 	P    uint64 // plaintext modulus
+
+	ElemBits uint64 // width of matrix entries: 32 (the default if zero) or 64
+}
+
+// elemBits returns the width of the matrix entries used with p.
+func (p *Params) elemBits() uint64 {
+	if p.ElemBits == 0 {
+		return elemBits
+	}
+	return p.ElemBits
+}
+
+// wide reports whether p selects 64-bit matrix entries.
+func (p *Params) wide() bool {
+	return p.elemBits() == 64
+}
+
+// lowBits returns v mod 2^n.
+func lowBits(v, n uint64) uint64 {
+	if n >= 64 {
+		return v
+	}
+	return v & (uint64(1)<<n - 1)
 }
 
 func (p *Params) deltah() float64 {
@@ -44,7 +71,114 @@ func ApproxSquareDatabase(d uint64) (uint64, uint64) {
 }
 
 func (p *Params) PrintParams() {
-	fmt.Printf("Working with: n=%d; db size=2^%d (l=%d, m=%d); logQ=%d; logq=%d; p=%d; unifrom=%d\n",
+	logf("Working with: n=%d; db size=2^%d (l=%d, m=%d); logQ=%d; logq=%d; p=%d; unifrom=%d; secret=%s\n",
 		p.N, int(math.Log2(float64(p.L))+math.Log2(float64(p.M))), p.L, p.M, p.LogQ, p.Logq,
-		p.P, p.Uniform)
+		p.P, p.Uniform, p.Secret)
+}
+
+// elemBits is the width of the C Elem type that all arithmetic mod Q and q
+// is carried out in, unless Params select the 64-bit Elem64.
+const elemBits = 32
+
+// Violation describes a single constraint that Params fail to meet.
+type Violation struct {
+	Field      string // name of the offending parameter
+	Value      uint64 // its value
+	Constraint string // the constraint it violates
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s=%d %s", v.Field, v.Value, v.Constraint)
+}
+
+// ValidationError lists every constraint violated by a set of Params. It
+// unwraps to ErrInvalidParams.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidParams, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidParams
+}
+
+// Validate checks that p can serve numRecords records of recordBits bits
+// each, before any database is allocated. It reports every violated
+// constraint at once, as a *ValidationError, or returns nil.
+func (p *Params) Validate(recordBits, numRecords uint64) error {
+	var vs []Violation
+	add := func(field string, value uint64, format string, args ...interface{}) {
+		vs = append(vs, Violation{Field: field, Value: value, Constraint: fmt.Sprintf(format, args...)})
+	}
+
+	if p.N == 0 {
+		add("N", p.N, "must be positive")
+	}
+	if p.L == 0 {
+		add("L", p.L, "must be positive")
+	}
+	if p.M == 0 {
+		add("M", p.M, "must be positive")
+	}
+	p.checkSecret(add)
+
+	// Arithmetic mod Q and q relies on the wrap-around of Elem, and squished
+	// entries must fit in a single Elem.
+	if p.ElemBits != 0 && p.ElemBits != 32 && p.ElemBits != 64 {
+		add("ElemBits", p.ElemBits, "must be 32 or 64")
+	}
+	basis, compression := squishSettings(p.wide())
+	if p.LogQ > p.elemBits() {
+		add("LogQ", p.LogQ, "must not exceed the %d-bit element width", p.elemBits())
+	}
+	if p.elemBits() < basis*compression {
+		add("ElemBits", p.ElemBits, "must be at least %d to squish %d entries of %d bits",
+			basis*compression, compression, basis)
+	}
+	if p.Logq == 0 || p.Logq > p.LogQ || p.Logq >= 64 {
+		add("Logq", p.Logq, "must be in [1, LogQ=%d] and below 64", p.LogQ)
+	}
+
+	// P must divide q, and shifted entries in [0, P) must fit in a digit of
+	// a squished element.
+	validP := p.P >= 2 && p.P&(p.P-1) == 0
+	if !validP {
+		add("P", p.P, "must be a power of two, at least 2")
+	}
+	if p.P > 1<<basis {
+		add("P", p.P, "must not exceed 2^%d for squished storage", basis)
+		validP = false
+	}
+	if p.Logq < 64 && p.P > 1<<p.Logq {
+		add("P", p.P, "must divide q=2^%d", p.Logq)
+		validP = false
+	}
+
+	if recordBits == 0 {
+		add("recordBits", recordBits, "must be positive")
+	}
+	if numRecords == 0 {
+		add("numRecords", numRecords, "must be positive")
+	}
+	if validP && recordBits > 0 && numRecords > 0 {
+		elems, ne, _ := Num_DB_entries(numRecords, recordBits, p.P)
+		if p.L%ne != 0 {
+			add("L", p.L, "must be a multiple of the %d Z_p elements per record", ne)
+		}
+		if p.L > 0 && p.M > 0 && elems > p.L*p.M {
+			add("M", p.M, "leaves room for %d Z_p elements, %d are needed", p.L*p.M, elems)
+		}
+	}
+
+	if len(vs) > 0 {
+		return &ValidationError{Violations: vs}
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 
 #include "pir.h"
 #include <stdio.h>
+#include <stdlib.h>
 #include <stddef.h>
 
 // Hard-coded, to allow for compiler optimizations:
@@ -99,6 +100,78 @@ void matMulTransposedPacked(Elem *out, const Elem *a, const Elem *b,
   }
 }
 
+// Number of packed columns that matMulPacked unpacks at a time, so that the
+// unpacked rows stay in the L1 cache while they are used for every column
+// of b.
+#define PACKED_CHUNK 256
+
+// Multiplies the packed matrix a by the unpacked matrix b, which has
+// aCols*COMPRESSION rows. Like matMulVecPacked, it works on blocks of 8 rows
+// of a, but unpacks every chunk of a block only once and then multiplies it
+// with all columns of b, so that unpacking and streaming a through memory
+// are shared by all columns. The columns of b are first copied out in the
+// same chunked order as the unpacked rows, so that all inner loops read
+// contiguous memory. Leftover rows form a smaller last block: unlike
+// matMulVecPacked, it never reads past the last row of a.
+void matMulPacked(Elem *out, const Elem *a, const Elem *b,
+    size_t aRows, size_t aCols, size_t bCols)
+{
+  size_t n = aCols*COMPRESSION;
+  Elem *bT = malloc(n*bCols*sizeof(Elem));
+  Elem *u = malloc(8*COMPRESSION*PACKED_CHUNK*sizeof(Elem));
+  Elem *acc = malloc(8*bCols*sizeof(Elem));
+  Elem db;
+
+  for (size_t k = 0; k < aCols; k++) {
+    size_t k0 = k - k%PACKED_CHUNK;
+    size_t kc = aCols - k0 < PACKED_CHUNK ? aCols - k0 : PACKED_CHUNK;
+    for (size_t c = 0; c < COMPRESSION; c++) {
+      for (size_t j = 0; j < bCols; j++) {
+        bT[n*j + COMPRESSION*k0 + kc*c + k - k0] = b[bCols*(COMPRESSION*k + c) + j];
+      }
+    }
+  }
+
+  for (size_t i = 0; i < aRows; i += 8) {
+    size_t rows = aRows - i < 8 ? aRows - i : 8;
+    for (size_t j = 0; j < 8*bCols; j++) {
+      acc[j] = 0;
+    }
+    for (size_t k0 = 0; k0 < aCols; k0 += PACKED_CHUNK) {
+      size_t kc = aCols - k0 < PACKED_CHUNK ? aCols - k0 : PACKED_CHUNK;
+      size_t m = COMPRESSION*kc;
+      for (size_t r = 0; r < 8; r++) {
+        const Elem *row = a + aCols*(i + (r < rows ? r : 0)) + k0;
+        Elem *ur = u + m*r;
+        for (size_t k = 0; k < kc; k++) {
+          db = row[k];
+          ur[k]        = db & MASK;
+          ur[kc+k]     = (db >> BASIS) & MASK;
+          ur[2*kc + k] = (db >> BASIS2) & MASK;
+        }
+      }
+      for (size_t j = 0; j < bCols; j++) {
+        const Elem *q = bT + n*j + COMPRESSION*k0;
+        Elem s[8] = {0};
+        for (size_t x = 0; x < m; x++) {
+          for (size_t r = 0; r < 8; r++) {
+            s[r] += u[m*r+x] * q[x];
+          }
+        }
+        for (size_t r = 0; r < 8; r++) {
+          acc[bCols*r+j] += s[r];
+        }
+      }
+    }
+    for (size_t j = 0; j < rows*bCols; j++) {
+      out[bCols*i + j] = acc[j];
+    }
+  }
+  free(acc);
+  free(u);
+  free(bT);
+}
+
 void matMulVec(Elem *out, const Elem *a, const Elem *b,
     size_t aRows, size_t aCols)
 {
@@ -224,3 +297,119 @@ void transpose(Elem *out, const Elem *in, size_t rows, size_t cols)
     }
   }
 }
+
+#define BASIS64     20
+#define BASIS64_2   BASIS64*2
+#define MASK64      (((Elem64)1<<BASIS64)-1)
+
+void matMul64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols, size_t bCols)
+{
+  for (size_t i = 0; i < aRows * bCols; ++i) {
+    out[i] = 0;
+  }
+
+  for (size_t k = 0; k < aCols; ++k) {
+    for (size_t i = 0; i < aRows; ++i) {
+      Elem64 val = a[aCols * i + k];
+      for (size_t j = 0; j < bCols; ++j) {
+        out[bCols * i + j] += val * b[bCols * k + j];
+      }
+    }
+  }
+}
+
+// matMulPacked64 is the 64-bit variant of matMulPacked.
+void matMulPacked64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols, size_t bCols)
+{
+  size_t n = aCols*COMPRESSION;
+  Elem64 *bT = malloc(n*bCols*sizeof(Elem64));
+  Elem64 *u = malloc(8*COMPRESSION*PACKED_CHUNK*sizeof(Elem64));
+  Elem64 *acc = malloc(8*bCols*sizeof(Elem64));
+  Elem64 db;
+
+  for (size_t k = 0; k < aCols; k++) {
+    size_t k0 = k - k%PACKED_CHUNK;
+    size_t kc = aCols - k0 < PACKED_CHUNK ? aCols - k0 : PACKED_CHUNK;
+    for (size_t c = 0; c < COMPRESSION; c++) {
+      for (size_t j = 0; j < bCols; j++) {
+        bT[n*j + COMPRESSION*k0 + kc*c + k - k0] = b[bCols*(COMPRESSION*k + c) + j];
+      }
+    }
+  }
+
+  for (size_t i = 0; i < aRows; i += 8) {
+    size_t rows = aRows - i < 8 ? aRows - i : 8;
+    for (size_t j = 0; j < 8*bCols; j++) {
+      acc[j] = 0;
+    }
+    for (size_t k0 = 0; k0 < aCols; k0 += PACKED_CHUNK) {
+      size_t kc = aCols - k0 < PACKED_CHUNK ? aCols - k0 : PACKED_CHUNK;
+      size_t m = COMPRESSION*kc;
+      for (size_t r = 0; r < 8; r++) {
+        const Elem64 *row = a + aCols*(i + (r < rows ? r : 0)) + k0;
+        Elem64 *ur = u + m*r;
+        for (size_t k = 0; k < kc; k++) {
+          db = row[k];
+          ur[k]        = db & MASK64;
+          ur[kc+k]     = (db >> BASIS64) & MASK64;
+          ur[2*kc + k] = (db >> BASIS64_2) & MASK64;
+        }
+      }
+      for (size_t j = 0; j < bCols; j++) {
+        const Elem64 *q = bT + n*j + COMPRESSION*k0;
+        Elem64 s[8] = {0};
+        for (size_t x = 0; x < m; x++) {
+          for (size_t r = 0; r < 8; r++) {
+            s[r] += u[m*r+x] * q[x];
+          }
+        }
+        for (size_t r = 0; r < 8; r++) {
+          acc[bCols*r+j] += s[r];
+        }
+      }
+    }
+    for (size_t j = 0; j < rows*bCols; j++) {
+      out[bCols*i + j] = acc[j];
+    }
+  }
+  free(acc);
+  free(u);
+  free(bT);
+}
+
+void matMulVec64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols)
+{
+  for (size_t i = 0; i < aRows; i++) {
+    Elem64 tmp0 = 0, tmp1 = 0;
+    size_t j = 0;
+    for (; j + 1 < aCols; j += 2) {
+      tmp0 += a[aCols*i + j + 0] * b[j + 0];
+      tmp1 += a[aCols*i + j + 1] * b[j + 1];
+    }
+    for (; j < aCols; j++) {
+      tmp0 += a[aCols*i + j] * b[j];
+    }
+    out[i] = tmp0 + tmp1;
+  }
+}
+
+void matMulVecPacked64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols)
+{
+  Elem64 db, tmp;
+  size_t index = 0;
+
+  for (size_t i = 0; i < aRows; i++) {
+    tmp = 0;
+    for (size_t j = 0; j < aCols; j++) {
+      db = a[index++];
+      tmp += (db & MASK64) * b[COMPRESSION*j];
+      tmp += ((db >> BASIS64) & MASK64) * b[COMPRESSION*j+1];
+      tmp += ((db >> BASIS64_2) & MASK64) * b[COMPRESSION*j+2];
+    }
+    out[i] = tmp;
+  }
+}
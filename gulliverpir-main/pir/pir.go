@@ -1,7 +1,6 @@
 package pir
 
 import (
-	"fmt"
 	"runtime"
 	"runtime/debug"
 	"time"
@@ -16,77 +15,119 @@ type PIR interface {
 
 	Init(info DBinfo, p Params) State
 
-	Setup(DB *Database, shared State, p Params) (State, Msg)
+	InitCompressed(info DBinfo, p Params) (State, CompressedState)
 
-	Query(i uint64, shared State, p Params, info DBinfo) (State, Msg)
+	DecompressState(info DBinfo, p Params, comp CompressedState) State
 
-	Answer(DB *Database, query MsgSlice, server State, shared State, p Params) Msg
+	Setup(DB *Database, shared State, p Params) (*ServerDB, Msg, error)
 
-	Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg, shared State, client State, p Params, info DBinfo) uint64
+	Query(i uint64, shared State, p Params, info DBinfo) (State, Msg, error)
 
-	Reset(DB *Database, p Params)
+	Answer(server *ServerDB, query MsgSlice, shared State, p Params) (Msg, error)
+
+	Recover(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg, shared State, client State, p Params, info DBinfo) (uint64, error)
+
+	RecoverBytes(i uint64, batch_index uint64, offline Msg, query Msg, answer Msg, shared State, client State, p Params, info DBinfo) ([]byte, error)
+
+	// Communication sizes in KB, as computed by calculateCommunicationSize.
+	OfflineSize(offline Msg, p Params) float64
+
+	QuerySize(query Msg, p Params) float64
+
+	AnswerSize(answer Msg, p Params) float64
+}
+
+// PreprocessingPIR is implemented by schemes whose clients can precompute
+// the index-independent part of their queries while idle.
+type PreprocessingPIR interface {
+	PIR
+
+	Precompute(offline Msg, shared State, p Params, info DBinfo) (State, error)
+
+	QueryPrecomputed(i uint64, pre State, p Params, info DBinfo) (State, Msg, error)
+}
+
+// ColumnPIR is implemented by schemes whose answers encode a whole database
+// column, so that one query recovers every entry stored in it.
+type ColumnPIR interface {
+	PIR
+
+	RecoverColumn(i uint64, offline Msg, query Msg, answer Msg, shared State, client State, p Params, info DBinfo) ([]uint64, error)
 }
 
 // RunPIR executes the full GulliverPIR scheme for a single query,
 // which includes both offline and online phases.
 func RunPIR(pi PIR, DB *Database, p Params, queryIndex uint64) (float64, float64) {
-	fmt.Printf("Executing %s\n", pi.Name())
+	logf("Executing %s\n", pi.Name())
 	debug.SetGCPercent(-1)
 	var bw float64
 	var clientState []State
 	var query MsgSlice
 
-	// Initialize the shared state.
-	sharedState := pi.Init(DB.Info, p)
+	// Initialize the shared state; clients only receive its seed.
+	sharedState, compressedState := pi.InitCompressed(DB.Info, p)
+	logf("\tShared state: %d bytes\n", compressedState.Size())
 
 	// Perform the setup phase.
-	fmt.Println("Setup...")
+	logf("Setup...\n")
 	startTime := time.Now()
-	serverState, offlineDownload := pi.Setup(DB, sharedState, p)
+	serverDB, offlineDownload, err := pi.Setup(DB, sharedState, p)
+	if err != nil {
+		panic(err)
+	}
 	printTime(startTime)
-	communicationSize := calculateCommunicationSize(offlineDownload.Size(), p.LogQ)
-	fmt.Printf("\tOffline download: %f KB\n", communicationSize)
+	communicationSize := pi.OfflineSize(offlineDownload, p)
+	logf("\tOffline download: %f KB\n", communicationSize)
 	bw += communicationSize
 	runtime.GC()
 
+	// Rebuild the shared state on the client side from its seed.
+	clientShared := pi.DecompressState(DB.Info, p, compressedState)
+
 	// Build the query for the given index.
-	fmt.Println("Building query...")
+	logf("Building query...\n")
 	startTime = time.Now()
-	cs, qu := pi.Query(queryIndex, sharedState, p, DB.Info)
+	cs, qu, err := pi.Query(queryIndex, clientShared, p, serverDB.Info())
+	if err != nil {
+		panic(err)
+	}
 	clientState = append(clientState, cs)
 	query.Data = append(query.Data, qu)
 	printTime(startTime)
-	communicationSize = calculateCommunicationSize(query.Size(), p.Logq)
-	fmt.Printf("\tOnline upload: %f KB\n", communicationSize)
+	communicationSize = pi.QuerySize(qu, p)
+	logf("\tOnline upload: %f KB\n", communicationSize)
 	bw += communicationSize
 	runtime.GC()
 
 	// Answer the query.
-	fmt.Println("Answering query...")
+	logf("Answering query...\n")
 	startTime = time.Now()
-	answer := pi.Answer(DB, query, serverState, sharedState, p)
+	answer, err := pi.Answer(serverDB, query, sharedState, p)
+	if err != nil {
+		panic(err)
+	}
 	elapsedTime := printTime(startTime)
 	transferRate := printRate(p, elapsedTime, 1)
-	communicationSize = calculateCommunicationSize(answer.Size(), p.Logq)
-	fmt.Printf("\tOnline download: %f KB\n", communicationSize)
+	communicationSize = pi.AnswerSize(answer, p)
+	logf("\tOnline download: %f KB\n", communicationSize)
 	bw += communicationSize
 	runtime.GC()
 
-	// Reset the database to its original state.
-	pi.Reset(DB, p)
-
 	// Reconstruct the queried element and verify correctness.
-	fmt.Println("Reconstructing...")
+	logf("Reconstructing...\n")
 	startTime = time.Now()
-	reconstructedValue := pi.Recover(queryIndex, 1, offlineDownload,
-		query.Data[0], answer, sharedState, clientState[0], p, DB.Info)
+	reconstructedValue, err := pi.Recover(queryIndex, 1, offlineDownload,
+		query.Data[0], answer, clientShared, clientState[0], p, serverDB.Info())
+	if err != nil {
+		panic(err)
+	}
 	expectedValue := DB.GetElem(queryIndex)
 	if reconstructedValue != expectedValue {
-		fmt.Printf("querying index %d --: Got %d instead of %d\n", queryIndex, reconstructedValue, expectedValue)
+		logf("querying index %d --: Got %d instead of %d\n", queryIndex, reconstructedValue, expectedValue)
 		panic("Reconstruct failed!")
 	}
-	fmt.Printf("Get index %d : %d \n", queryIndex, expectedValue)
-	fmt.Println("Success!")
+	logf("Get index %d : %d \n", queryIndex, expectedValue)
+	logf("Success!\n")
 	printTime(startTime)
 
 	// Restore the garbage collection to its default settings.
@@ -11,8 +11,27 @@ void matMul(Elem *out, const Elem *a, const Elem *b,
 void matMulTransposedPacked(Elem *out, const Elem *a, const Elem *b,
     size_t aRows, size_t aCols, size_t bRows, size_t bCols);
 
+void matMulPacked(Elem *out, const Elem *a, const Elem *b,
+    size_t aRows, size_t aCols, size_t bCols);
+
 void matMulVec(Elem *out, const Elem *a, const Elem *b,
     size_t aRows, size_t aCols);
 
 void matMulVecPacked(Elem *out, const Elem *a, const Elem *b,
     size_t aRows, size_t aCols);
+
+// 64-bit variants of the kernels above, for parameters with LogQ > 32. The
+// packed kernels squish three entries of BASIS64 bits into each element.
+typedef uint64_t Elem64;
+
+void matMul64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols, size_t bCols);
+
+void matMulPacked64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols, size_t bCols);
+
+void matMulVec64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols);
+
+void matMulVecPacked64(Elem64 *out, const Elem64 *a, const Elem64 *b,
+    size_t aRows, size_t aCols);
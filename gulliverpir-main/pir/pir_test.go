@@ -1,10 +1,19 @@
 package pir
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Test GulliverPIR correctness on DB with short entries.
@@ -23,3 +32,1649 @@ func TestGulliverPIR(t *testing.T) {
 	}
 
 }
+
+// Test that the public matrix can be rebuilt from its seed.
+func TestCompressedState(t *testing.T) {
+	pir := GulliverPIR{}
+	p := pir.PickParams(1<<10, 1<<16, 1<<10, 32, 28)
+	shared, comp := pir.InitCompressed(DBinfo{}, p)
+	rebuilt := pir.DecompressState(DBinfo{}, p, comp)
+	A, B := shared.Data[0], rebuilt.Data[0]
+	if A.Rows != B.Rows || A.Cols != B.Cols {
+		t.Fatalf("dimension mismatch: %d-by-%d vs. %d-by-%d", A.Rows, A.Cols, B.Rows, B.Cols)
+	}
+	for i := range A.Data {
+		if A.Data[i] != B.Data[i] {
+			t.Fatalf("entry %d differs after decompression", i)
+		}
+	}
+}
+
+// Test that invalid inputs are reported as errors instead of panics.
+func TestErrors(t *testing.T) {
+	pir := GulliverPIR{}
+	p := pir.PickParams(1<<10, 1<<16, 1<<10, 32, 28)
+	bad := p
+	bad.L = 0
+	if _, err := NewDatabase(1<<16, 8, &bad); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams, got %v", err)
+	}
+	if _, err := NewDatabaseFromValues(2, 8, &p, []uint64{1}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams, got %v", err)
+	}
+
+	DB, err := NewRandomDatabase(1<<16, uint64(math.Log2(float64(p.P))), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := pir.Init(DB.Info, p)
+	if _, _, err := pir.Setup(DB, MakeState(), p); !errors.Is(err, ErrMalformedMsg) {
+		t.Fatalf("expected ErrMalformedMsg, got %v", err)
+	}
+	server, _, err := pir.Setup(DB, shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pir.Query(DB.Info.Num, shared, p, server.Info()); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatalf("expected ErrIndexOutOfRange, got %v", err)
+	}
+	short := MakeMsgSlice(MakeMsg(MatrixZeros(p.M-1, 1)))
+	if _, err := pir.Answer(server, short, shared, p); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("expected ErrDimensionMismatch, got %v", err)
+	}
+}
+
+// Test batched answering of independent full-DB queries.
+func TestGulliverPIRBatch(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 20)
+	pir := GulliverPIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	shared := pir.Init(DB.Info, p)
+	server, offline, err := pir.Setup(DB, shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []int{1, 4, 16} {
+		var indices []uint64
+		var clients []State
+		var queries MsgSlice
+		for j := 0; j < k; j++ {
+			index := RandInt(big.NewInt(int64(d))).Uint64()
+			cs, q, err := pir.Query(index, shared, p, server.Info())
+			if err != nil {
+				t.Fatal(err)
+			}
+			indices = append(indices, index)
+			clients = append(clients, cs)
+			queries.Data = append(queries.Data, q)
+		}
+
+		fmt.Printf("Answering batch of %d queries...\n", k)
+		start := time.Now()
+		answers, err := pir.AnswerBatch(server, queries, shared, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		printRate(p, printTime(start), k)
+
+		for j, index := range indices {
+			val, err := pir.Recover(index, 0, offline, queries.Data[j], answers.Data[j], shared, clients[j], p, server.Info())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != DB.GetElem(index) {
+				t.Fatalf("batch %d: got %d instead of %d at index %d", k, val, DB.GetElem(index), index)
+			}
+		}
+	}
+}
+
+// batchBenchSetup builds a GulliverPIR server and k random queries for the
+// AnswerBatch benchmarks.
+func batchBenchSetup(b *testing.B, k int) (*GulliverPIR, *ServerDB, MsgSlice, State, Params) {
+	SetLogOutput(nil)
+	b.Cleanup(func() { SetLogOutput(os.Stdout) })
+	N := uint64(1 << 10)
+	d := uint64(1 << 20)
+	pir := &GulliverPIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	shared := pir.Init(DB.Info, p)
+	server, _, err := pir.Setup(DB, shared, p)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var queries MsgSlice
+	for j := 0; j < k; j++ {
+		_, q, err := pir.Query(RandInt(big.NewInt(int64(d))).Uint64(), shared, p, server.Info())
+		if err != nil {
+			b.Fatal(err)
+		}
+		queries.Data = append(queries.Data, q)
+	}
+	return pir, server, queries, shared, p
+}
+
+// Benchmark answering k queries in one batch; compare with
+// BenchmarkAnswerSingle to see the gain over answering them one by one.
+func BenchmarkAnswerBatch(b *testing.B) {
+	for _, k := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("k=%d", k), func(b *testing.B) {
+			pir, server, queries, shared, p := batchBenchSetup(b, k)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := pir.AnswerBatch(server, queries, shared, p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark answering the same k queries with one Answer call each.
+func BenchmarkAnswerSingle(b *testing.B) {
+	for _, k := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("k=%d", k), func(b *testing.B) {
+			pir, server, queries, shared, p := batchBenchSetup(b, k)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, q := range queries.Data {
+					if _, err := pir.Answer(server, MakeMsgSlice(q), shared, p); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Test that Answer can be called concurrently and leaves the database intact.
+func TestConcurrentAnswer(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	pir := GulliverPIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	original := DB.Data.RowsDeepCopy(0, DB.Data.Rows)
+	shared := pir.Init(DB.Info, p)
+	server, offline, err := pir.Setup(DB, shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range original.Data {
+		if original.Data[i] != DB.Data.Data[i] {
+			t.Fatalf("Setup modified database entry %d", i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			index := RandInt(big.NewInt(int64(d))).Uint64()
+			cs, q, err := pir.Query(index, shared, p, server.Info())
+			if err != nil {
+				errs <- err
+				return
+			}
+			ans, err := pir.Answer(server, MakeMsgSlice(q), shared, p)
+			if err != nil {
+				errs <- err
+				return
+			}
+			val, err := pir.Recover(index, 0, offline, q, ans, shared, cs, p, server.Info())
+			if err != nil {
+				errs <- err
+				return
+			}
+			if val != DB.GetElem(index) {
+				errs <- fmt.Errorf("got %d instead of %d at index %d", val, DB.GetElem(index), index)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Test DoublePIR correctness on DB with short entries.
+func TestDoublePIR(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 20)
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	index := RandInt(big.NewInt(int64(d))).Uint64()
+	RunPIR(&pir, DB, p, index)
+}
+
+// Test that DoublePIR rejects hints and answers of the wrong shape or width
+// instead of panicking.
+func TestDoublePIRMalformedAnswer(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	pir := DoublePIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	shared := pir.Init(DB.Info, p)
+	server, offline, err := pir.Setup(DB, shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := RandInt(big.NewInt(int64(d))).Uint64()
+	cs, q, err := pir.Query(index, shared, p, server.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pir.Answer(server, MakeMsgSlice(q), shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := pir.Recover(index, 0, offline, q, answer, shared, cs, p, server.Info()); err != nil || val != DB.GetElem(index) {
+		t.Fatalf("got %d, %v instead of %d", val, err, DB.GetElem(index))
+	}
+
+	replace := func(m Msg, j int, with *Matrix) Msg {
+		out := MakeMsg(m.Data...)
+		out.Data[j] = with
+		return out
+	}
+	for j := range answer.Data {
+		orig := answer.Data[j]
+		for _, bad := range []*Matrix{MatrixNew64(orig.Rows, orig.Cols), MatrixZeros(orig.Rows-1, orig.Cols), MatrixZeros(orig.Rows, orig.Cols+1)} {
+			_, err := pir.Recover(index, 0, offline, q, replace(answer, j, bad), shared, cs, p, server.Info())
+			if !errors.Is(err, ErrDimensionMismatch) && !errors.Is(err, ErrMalformedMsg) {
+				t.Fatalf("answer component %d: expected an error, got %v", j, err)
+			}
+		}
+	}
+	H := offline.Data[0]
+	for _, bad := range []*Matrix{MatrixNew64(H.Rows, H.Cols), MatrixZeros(H.Rows, H.Cols-1)} {
+		_, err := pir.Recover(index, 0, MakeMsg(bad), q, answer, shared, cs, p, server.Info())
+		if !errors.Is(err, ErrDimensionMismatch) && !errors.Is(err, ErrMalformedMsg) {
+			t.Fatalf("hint: expected an error, got %v", err)
+		}
+	}
+}
+
+// Test that the DoublePIR hint is only smaller than the GulliverPIR hint for
+// databases with more than κ·N rows.
+func TestDoublePIRHintSize(t *testing.T) {
+	N := uint64(1 << 10)
+	gpir, dpir := GulliverPIR{}, DoublePIR{}
+
+	// HintSize matches the hints Setup produces.
+	d := uint64(1 << 16)
+	p := dpir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	for _, pi := range []interface {
+		PIR
+		HintSize(Params, DBinfo) float64
+	}{&gpir, &dpir} {
+		_, offline, err := pi.Setup(DB, pi.Init(DB.Info, p), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := pi.HintSize(p, DB.Info), pi.OfflineSize(offline, p); got != want {
+			t.Fatalf("%s: HintSize is %.0f KB, the hint takes %.0f KB", pi.Name(), got, want)
+		}
+	}
+
+	// The crossover is where the type documentation puts it, and DoublePIR
+	// has the smaller hint from there on.
+	info := DBinfo{Ne: 1}
+	cross := dpir.MinRecords(N, N, 32, 28, 1)
+	if cross != 1<<25 {
+		t.Fatalf("DoublePIR pays off from %d records, expected 2^25", cross)
+	}
+	for d := cross / 4; d <= cross<<3; d <<= 1 {
+		p := gpir.PickParams(N, d, N, 32, 28)
+		single, double := gpir.HintSize(p, info), dpir.HintSize(p, info)
+		fmt.Printf("d=%d (L=%d): GulliverPIR hint %.0f KB, DoublePIR hint %.0f KB\n", d, p.L, single, double)
+		if (double < single) != (d >= cross) {
+			t.Fatalf("d=%d: GulliverPIR hint %.0f KB, DoublePIR hint %.0f KB", d, single, double)
+		}
+	}
+}
+
+// Test the Client and Server types over their encoded messages.
+func TestClient(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	pir := GulliverPIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	server, err := NewServer(&pir, DB, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := server.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint, err := server.Hint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Preprocess(2); err != nil {
+		t.Fatal(err)
+	}
+
+	var handles []QueryHandle
+	var answers [][]byte
+	var indices []uint64
+	for j := 0; j < 3; j++ {
+		index := RandInt(big.NewInt(int64(d))).Uint64()
+		h, q, err := client.Query(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans, err := server.Answer(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+		answers = append(answers, ans)
+		indices = append(indices, index)
+	}
+	for j := len(handles) - 1; j >= 0; j-- {
+		val, err := client.Recover(handles[j], answers[j])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != DB.GetElem(indices[j]) {
+			t.Fatalf("got %d instead of %d at index %d", val, DB.GetElem(indices[j]), indices[j])
+		}
+	}
+	if client.Precomputed() != 0 {
+		t.Fatalf("%d precomputed queries left unused", client.Precomputed())
+	}
+	if _, err := client.Recover(handles[0], answers[0]); !errors.Is(err, ErrMalformedMsg) {
+		t.Fatalf("expected ErrMalformedMsg for a recovered handle, got %v", err)
+	}
+	if _, err := server.Answer([]byte{1, 2, 3}); !errors.Is(err, ErrMalformedMsg) {
+		t.Fatalf("expected ErrMalformedMsg, got %v", err)
+	}
+}
+
+// Test recovering a whole column, on a DB packing two entries per Z_p element.
+func TestRecoverColumn(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	pir := GulliverPIR{}
+	p := pir.PickParams(N, d, N, 32, 28)
+	num := 2*d - 1
+	vals := make([]uint64, num)
+	for i := range vals {
+		vals[i] = RandInt(big.NewInt(16)).Uint64()
+	}
+	DB := MakeDB(num, 4, &p, vals)
+	if DB.Info.Packing != 2 {
+		t.Fatalf("expected 2 entries per Z_p element, got %d", DB.Info.Packing)
+	}
+	server, err := NewServer(&pir, DB, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := num - 1
+	h, q, err := client.Query(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans, err := server.Answer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices, got, err := client.RecoverColumn(h, ans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(indices)) != 2*p.L-1 {
+		t.Fatalf("got %d entries in column, expected %d", len(indices), 2*p.L-1)
+	}
+	found := false
+	for k, i := range indices {
+		if got[k] != vals[i] {
+			t.Fatalf("got %d instead of %d at index %d", got[k], vals[i], i)
+		}
+		found = found || i == index
+	}
+	if !found {
+		t.Fatalf("column does not contain queried index %d", index)
+	}
+}
+
+// Test keyword lookups through the cuckoo-hashing layer.
+func TestKeywordPIR(t *testing.T) {
+	N := uint64(1 << 10)
+	pir := GulliverPIR{}
+	p := pir.PickParams(N, 1<<16, N, 32, 28)
+	pairs := make(map[string]uint64)
+	for i := 0; i < 2000; i++ {
+		pairs[fmt.Sprintf("user-%d", i)] = RandInt(big.NewInt(1 << 20)).Uint64()
+	}
+	table, err := NewKeywordTable(pairs, 20, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB, err := table.Database(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(&pir, DB, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	kwParams, _ := table.Params.MarshalBinary()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc, err := NewKeywordClient(client, kwParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(key string) (uint64, error) {
+		h, queries, err := kc.Query(key)
+		if err != nil {
+			return 0, err
+		}
+		var answers [][]byte
+		for _, q := range queries {
+			ans, err := server.Answer(q)
+			if err != nil {
+				return 0, err
+			}
+			answers = append(answers, ans)
+		}
+		return kc.Recover(h, answers)
+	}
+	for _, key := range []string{"user-0", "user-1234", "user-1999"} {
+		val, err := lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != pairs[key] {
+			t.Fatalf("got %d instead of %d for %q", val, pairs[key], key)
+		}
+	}
+	if _, err := lookup("user-2000"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// Test byte-string records that span several Z_p elements, as well as short
+// records that are packed together.
+func TestByteRecords(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	for _, pi := range []PIR{&GulliverPIR{}, &DoublePIR{}} {
+		for _, recordLen := range []uint64{20, 1} {
+			p := pi.PickParams(N, d, N, 32, 28)
+			num := d / (8*recordLen + 1)
+			records := make([][]byte, num)
+			for i := range records {
+				records[i] = make([]byte, recordLen)
+				for j := range records[i] {
+					records[i][j] = byte(RandInt(big.NewInt(256)).Uint64())
+				}
+			}
+			DB := MakeDBBytes(num, recordLen, &p, records)
+			server, err := NewServer(pi, DB, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params, _ := server.Params()
+			hint, _ := server.Hint()
+			client, err := NewClient(pi, params, hint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, index := range []uint64{0, num - 1, RandInt(big.NewInt(int64(num))).Uint64()} {
+				if got := DB.GetElemBytes(index); !bytes.Equal(got, records[index]) {
+					t.Fatalf("%s: database holds %x instead of %x at index %d", pi.Name(), got, records[index], index)
+				}
+				h, q, err := client.Query(index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ans, err := server.Answer(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := client.RecoverBytes(h, ans)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, records[index]) {
+					t.Fatalf("%s: got %x instead of %x at index %d", pi.Name(), got, records[index], index)
+				}
+			}
+		}
+	}
+	p := (&GulliverPIR{}).PickParams(N, d, N, 32, 28)
+	if _, err := NewDatabaseFromBytes(2, 4, &p, [][]byte{{1, 2, 3, 4}, {5}}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for a short record, got %v", err)
+	}
+}
+
+// Test that the security estimate grows with the secret dimension and that
+// PickSecureParams meets its target.
+func TestSecurityEstimate(t *testing.T) {
+	d := uint64(1 << 20)
+	pir := GulliverPIR{}
+	prev := 0.0
+	for _, n := range []uint64{512, 1024, 2048} {
+		p := pir.PickParams(n, d, n, 32, 28)
+		bits := EstimateSecurity(p).Bits()
+		if bits <= prev {
+			t.Fatalf("security does not grow with n: %.1f bits at n=%d after %.1f", bits, n, prev)
+		}
+		prev = bits
+	}
+
+	p := pir.PickParams(512, d, 512, 32, 28)
+	if err := p.CheckSecurity(128); !errors.Is(err, ErrInsecureParams) {
+		t.Fatalf("expected ErrInsecureParams for n=512, got %v", err)
+	}
+	p, err := pir.PickSecureParams(512, d, 512, 32, 28, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckSecurity(128); err != nil {
+		t.Fatal(err)
+	}
+	if p.N <= 512 {
+		t.Fatalf("expected a larger secret dimension, got n=%d", p.N)
+	}
+	if _, err := pir.PickSecureParams(512, d, 512, 32, 28, 10000); !errors.Is(err, ErrInsecureParams) {
+		t.Fatalf("expected ErrInsecureParams for an unreachable target, got %v", err)
+	}
+
+	// Small dimensions, where no block size below the lattice dimension
+	// succeeds, still give finite estimates.
+	for _, c := range []struct{ n, m uint64 }{{8, 3}, {16, 0}, {1, 1}, {64, 6}} {
+		p := Params{N: c.n, M: c.m, L: 1, LogQ: 32, Logq: 28, Uniform: 16}
+		est := EstimateSecurity(p)
+		for _, v := range []float64{est.Primal, est.Dual} {
+			if math.IsInf(v, 0) || math.IsNaN(v) || v <= 0 {
+				t.Fatalf("n=%d, M=%d: got %s", c.n, c.m, est)
+			}
+		}
+		if est.Bits() > coreSVPExponent*float64(c.n+c.m+1) {
+			t.Fatalf("n=%d, M=%d: %s exceeds the cost of reducing the whole lattice", c.n, c.m, est)
+		}
+	}
+}
+
+// Test the failure probability bound and the choice of P by target error rate.
+func TestFailureProbability(t *testing.T) {
+	p := Params{N: 1024, M: 1 << 12, LogQ: 32, Logq: 28, P: 1 << 10}
+	base := p.logElemFailure()
+	if base > defaultLogFailure {
+		t.Fatalf("failure probability 2^%.1f above target 2^%d", base, defaultLogFailure)
+	}
+	wide := p
+	wide.M *= 16
+	if wide.logElemFailure() <= base {
+		t.Fatalf("failure probability does not grow with M")
+	}
+	if got := LogFailureProbability(p, DBinfo{Ne: 8}); math.Abs(got-(base+3)) > 1e-9 {
+		t.Fatalf("got 2^%.1f for 8 elements per entry, expected 2^%.1f", got, base+3)
+	}
+
+	// A shorter query modulus forces a smaller P for the same target.
+	p.Logq = 20
+	P := pickPlaintextModulus(p, defaultLogFailure)
+	p.P = P
+	if P >= 1<<10 || p.logElemFailure() > defaultLogFailure {
+		t.Fatalf("picked P=%d with failure probability 2^%.1f", P, p.logElemFailure())
+	}
+	p.P = 2 * P
+	if p.logElemFailure() <= defaultLogFailure {
+		t.Fatalf("P=%d is not the largest modulus meeting the target", P)
+	}
+}
+
+// Test that Validate reports every violated constraint at once.
+func TestValidate(t *testing.T) {
+	pir := GulliverPIR{}
+	p := pir.PickParams(1<<10, 1<<16, 1<<10, 32, 28)
+	if err := p.Validate(uint64(math.Log2(float64(p.P))), 1<<16); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := p
+	bad.LogQ = 40
+	bad.P = 3 << 10
+	bad.M = 1
+	err := bad.Validate(26*10, 1<<10)
+	if !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams, got %v", err)
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a *ValidationError, got %T", err)
+	}
+	fields := make(map[string]int)
+	for _, v := range verr.Violations {
+		fields[v.Field]++
+	}
+	if fields["LogQ"] != 1 || fields["P"] != 2 || len(verr.Violations) != 3 {
+		t.Fatalf("unexpected violations: %v", verr)
+	}
+
+	bad = p
+	bad.M = 1
+	err = bad.Validate(26*10, 1<<10)
+	if !errors.As(err, &verr) || len(verr.Violations) != 2 {
+		t.Fatalf("expected violations of L and M, got %v", err)
+	}
+}
+
+// Test that the planned shape is valid, beats the square shape and serves
+// queries.
+func TestPlanParams(t *testing.T) {
+	num, bits := uint64(1<<12), uint64(64)
+	w := CostWeights{Offline: 0.01, Upload: 1, Download: 1}
+	plan, err := PlanParams(num, bits, 1<<10, 32, 28, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := plan.Params
+	if p.M%squishCompression != 0 || p.L%plan.Ne != 0 {
+		t.Fatalf("shape l=%d, m=%d does not fit Ne=%d and squishing", p.L, p.M, plan.Ne)
+	}
+
+	square := p
+	elems, ne, _ := Num_DB_entries(num, bits, p.P)
+	square.L, square.M = ApproxSquareDatabase(elems)
+	square.L = (square.L + ne - 1) / ne * ne
+	squareCost := w.Offline*float64(commBytes(square.L*square.N, square.LogQ)) +
+		w.Upload*float64(commBytes(square.M, square.Logq)) + w.Download*float64(commBytes(square.L, square.Logq))
+	if plan.Cost > squareCost {
+		t.Fatalf("planned cost %.0f exceeds cost %.0f of the square shape", plan.Cost, squareCost)
+	}
+
+	vals := make([]uint64, num)
+	for i := range vals {
+		vals[i] = RandInt(new(big.Int).Lsh(big.NewInt(1), uint(bits))).Uint64()
+	}
+	DB := MakeDB(num, bits, &p, vals)
+	pir := GulliverPIR{}
+	index := RandInt(big.NewInt(int64(num))).Uint64()
+	shared := pir.Init(DB.Info, p)
+	server, offline, err := pir.Setup(DB, shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, query, err := pir.Query(index, shared, p, server.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pir.Answer(server, MakeMsgSlice(query), shared, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commBytes(answer.Size(), p.Logq); got != plan.DownloadBytes {
+		t.Fatalf("answer has %d bytes, predicted %d", got, plan.DownloadBytes)
+	}
+	val, err := pir.Recover(index, 0, offline, query, answer, shared, client, p, server.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != vals[index] {
+		t.Fatalf("got %d instead of %d at index %d", val, vals[index], index)
+	}
+}
+
+// Test that the registered presets meet their guarantees and that their
+// encodings round-trip.
+func TestPresets(t *testing.T) {
+	for _, name := range PresetNames() {
+		preset, err := LookupPreset(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := preset.Params(preset.MaxM * preset.MaxM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.logElemFailure() > defaultLogFailure {
+			t.Fatalf("%s: failure probability 2^%.1f at m=%d", name, p.logElemFailure(), p.M)
+		}
+		if p.Secret != preset.Secret || p.ElemBits != preset.ElemBits || p.ElemBits == 0 {
+			t.Fatalf("%s: params use secret %s and %d-bit elements", name, p.Secret, p.ElemBits)
+		}
+		if preset.N >= 2048 {
+			if err := p.CheckSecurity(128); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if _, err := preset.Params(4 * preset.MaxM * preset.MaxM); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("%s: expected ErrInvalidParams beyond the maximal width, got %v", name, err)
+		}
+
+		enc, _ := preset.MarshalBinary()
+		var dec Preset
+		if err := dec.UnmarshalBinary(enc); err != nil || dec != preset {
+			t.Fatalf("%s: binary encoding does not round-trip: %v", name, err)
+		}
+		js, err := json.Marshal(&preset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec = Preset{}
+		if err := json.Unmarshal(js, &dec); err != nil || dec != preset {
+			t.Fatalf("%s: JSON encoding does not round-trip: %v", name, err)
+		}
+		if _, err := MatchPreset(name, dec.Fingerprint()); err != nil {
+			t.Fatal(err)
+		}
+		dec.MaxM++
+		if _, err := MatchPreset(name, dec.Fingerprint()); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("%s: expected ErrInvalidParams for a mismatching preset, got %v", name, err)
+		}
+	}
+	if _, err := LookupPreset("unknown"); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for an unknown preset, got %v", err)
+	}
+	bad, _ := LookupPreset("n1024-p1024-v1")
+	bad.Name, bad.ElemBits = "no-width", 0
+	if err := RegisterPreset(bad); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for a preset without an element width, got %v", err)
+	}
+	bad.ElemBits, bad.P = 32, 1<<12
+	if err := RegisterPreset(bad); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for a preset that fails validation, got %v", err)
+	}
+
+	preset, _ := LookupPreset("n1024-p1024-v1")
+	d := uint64(1 << 16)
+	p, err := preset.Params(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pir := GulliverPIR{}
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	RunPIR(&pir, DB, p, RandInt(big.NewInt(int64(d))).Uint64())
+}
+
+// Test GulliverPIR with 64-bit elements, through RunPIR, batching and the
+// encoded Client/Server interface.
+func TestGulliverPIR64(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	pir := GulliverPIR{}
+	p := pir.PickParams(N, d, N, 64, 56)
+	if !p.wide() || p.P <= 1<<squishBasis {
+		t.Fatalf("expected 64-bit elements and a larger plaintext modulus, got %d bits and p=%d", p.elemBits(), p.P)
+	}
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	RunPIR(&pir, DB, p, RandInt(big.NewInt(int64(d))).Uint64())
+
+	server, err := NewServer(&pir, DB, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Preprocess(1); err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 2; j++ {
+		index := RandInt(big.NewInt(int64(d))).Uint64()
+		h, q, err := client.Query(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans, err := server.Answer(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := client.Recover(h, ans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != DB.GetElem(index) {
+			t.Fatalf("got %d instead of %d at index %d", val, DB.GetElem(index), index)
+		}
+	}
+
+	dpir := DoublePIR{}
+	if _, _, err := dpir.Setup(DB, dpir.Init(DB.Info, p), p); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for DoublePIR with 64-bit elements, got %v", err)
+	}
+	narrow := p
+	narrow.ElemBits = 32
+	if err := narrow.Validate(DB.Info.Row_length, d); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for logQ=64 with 32-bit elements, got %v", err)
+	}
+
+	// Moduli between 32 and 64 bits also use 64-bit elements.
+	for _, c := range []struct{ logQ, logq uint64 }{{40, 32}, {48, 40}} {
+		p := pir.PickParams(N, d, N, c.logQ, c.logq)
+		if !p.wide() {
+			t.Fatalf("logQ=%d: expected 64-bit elements, got %d bits", c.logQ, p.elemBits())
+		}
+		if err := p.Validate(uint64(math.Log2(float64(p.P))), d); err != nil {
+			t.Fatalf("logQ=%d: %v", c.logQ, err)
+		}
+		DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+		RunPIR(&pir, DB, p, RandInt(big.NewInt(int64(d))).Uint64())
+	}
+}
+
+// Test retrieval and the security estimate under every secret distribution.
+func TestSecretDistributions(t *testing.T) {
+	N := uint64(1 << 10)
+	d := uint64(1 << 16)
+	pir := GulliverPIR{}
+	base := pir.PickParams(N, d, N, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(base.P))), &base)
+
+	bits := map[SecretDist]float64{}
+	for _, dist := range []SecretDist{SecretUniform, SecretTernary, SecretBinary, SecretBinomial, SecretHammingWeight} {
+		p := base
+		p.Secret = dist
+		switch dist {
+		case SecretBinomial:
+			p.SecretParam = 2
+		case SecretHammingWeight:
+			p.SecretParam = 64
+		}
+		bits[dist] = EstimateSecurity(p).Bits()
+
+		server, err := NewServer(&pir, DB, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, _ := server.Params()
+		hint, _ := server.Hint()
+		client, err := NewClient(&pir, params, hint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := RandInt(big.NewInt(int64(d))).Uint64()
+		h, q, err := client.Query(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans, err := server.Answer(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := client.Recover(h, ans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != DB.GetElem(index) {
+			t.Fatalf("%s secret: got %d instead of %d at index %d", dist, val, DB.GetElem(index), index)
+		}
+	}
+	if !(bits[SecretHammingWeight] < bits[SecretBinary] && bits[SecretBinary] < bits[SecretTernary] &&
+		bits[SecretTernary] < bits[SecretUniform]) {
+		t.Fatalf("security does not follow the secret variance: %v", bits)
+	}
+
+	p := base
+	p.Secret = SecretHammingWeight
+	p.SecretParam = N + 1
+	if err := p.Validate(DB.Info.Row_length, d); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for a Hamming weight above N, got %v", err)
+	}
+	p.Secret = SecretDist(99)
+	if err := p.Validate(DB.Info.Row_length, d); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for an unknown distribution, got %v", err)
+	}
+}
+
+// Test that Explore tabulates every setting of a grid and reports the
+// settings it cannot plan.
+func TestExplore(t *testing.T) {
+	g := ExploreGrid{
+		N:          []uint64{1 << 10, 1 << 11},
+		LogD:       []uint64{12},
+		RecordBits: []uint64{8, 64},
+		LogQ:       []uint64{32},
+		Logq:       []uint64{28, 40},
+		Weights:    CostWeights{Offline: 1, Upload: 1, Download: 1},
+		Time:       true,
+	}
+	rows := Explore(g)
+	if len(rows) != 8 {
+		t.Fatalf("expected 8 rows, got %d", len(rows))
+	}
+	for _, r := range rows {
+		if len(r.Record()) != len(ExploreHeader()) {
+			t.Fatalf("record has %d fields, header has %d", len(r.Record()), len(ExploreHeader()))
+		}
+		if r.Logq > r.LogQ {
+			if r.Err == "" {
+				t.Fatalf("expected an error for logq=%d > logQ=%d", r.Logq, r.LogQ)
+			}
+			continue
+		}
+		if r.Err != "" {
+			t.Fatal(r.Err)
+		}
+		if r.L*r.M < (uint64(1)<<r.LogD)*r.Ne || r.Security <= 0 || r.LogFailure > defaultLogFailure {
+			t.Fatalf("unexpected row %+v", r)
+		}
+		if r.SetupSeconds <= 0 || r.AnswerSeconds <= 0 {
+			t.Fatalf("missing timings in row %+v", r)
+		}
+	}
+
+	// Tiny settings still encode as JSON, and their progress messages go
+	// where SetLogOutput sends them.
+	var log bytes.Buffer
+	SetLogOutput(&log)
+	defer SetLogOutput(os.Stdout)
+	g = ExploreGrid{N: []uint64{4, 16}, LogD: []uint64{2, 4}, RecordBits: []uint64{8}, LogQ: []uint64{32}, Logq: []uint64{28}, Time: true}
+	if _, err := json.Marshal(Explore(g)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "Total packed DB size") {
+		t.Fatalf("expected progress messages in the log, got %q", log.String())
+	}
+}
+
+// Test loading databases from fixed-width, CSV and line-delimited input.
+func TestLoadDatabase(t *testing.T) {
+	load := func(input string, opt LoadOptions) *Database {
+		r := bytes.NewReader([]byte(input))
+		num, rowLength, err := ScanRecords(r, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := PlanParams(num, rowLength, 1<<10, 32, 28, CostWeights{Offline: 1, Upload: 1, Download: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		DB, err := LoadDatabase(r, &plan.Params, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if DB.Info.Num != num || DB.Info.Row_length != rowLength {
+			t.Fatalf("loaded %d records of %d bits, scanned %d of %d", DB.Info.Num, DB.Info.Row_length, num, rowLength)
+		}
+		return DB
+	}
+
+	var fixed bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&fixed, "%03d", i)
+	}
+	for _, width := range []uint64{1, 3} {
+		DB := load(fixed.String(), LoadOptions{Format: FormatFixedWidth, RecordLen: width})
+		for i := uint64(0); i < DB.Info.Num; i++ {
+			if got, want := DB.GetElemBytes(i), fixed.Bytes()[i*width:(i+1)*width]; !bytes.Equal(got, want) {
+				t.Fatalf("fixed-width record %d: got %q instead of %q", i, got, want)
+			}
+		}
+	}
+
+	csvInput := "id,value\n"
+	for i := 0; i < 500; i++ {
+		csvInput += fmt.Sprintf("%d,%d\n", i, (i*37)%200)
+	}
+	DB := load(csvInput, LoadOptions{Format: FormatCSV, Column: 1, Header: true})
+	if DB.Info.Num != 500 || DB.Info.Row_length != 8 {
+		t.Fatalf("expected 500 records of 8 bits, got %d of %d", DB.Info.Num, DB.Info.Row_length)
+	}
+	for i := uint64(0); i < DB.Info.Num; i++ {
+		if got := DB.GetElem(i); got != (i*37)%200 {
+			t.Fatalf("CSV record %d: got %d instead of %d", i, got, (i*37)%200)
+		}
+	}
+
+	lines := []string{"alpha", "", "gamma delta", "epsilon"}
+	DB = load(strings.Join(lines, "\r\n")+"\n", LoadOptions{Format: FormatLines})
+	if DB.Info.Num != uint64(len(lines)) {
+		t.Fatalf("expected %d lines, got %d", len(lines), DB.Info.Num)
+	}
+	for i, line := range lines {
+		if got := string(bytes.TrimRight(DB.GetElemBytes(uint64(i)), "\x00")); got != line {
+			t.Fatalf("line %d: got %q instead of %q", i, got, line)
+		}
+	}
+
+	p := Params{}
+	if _, err := LoadDatabase(bytes.NewReader([]byte("abcde")), &p, LoadOptions{RecordLen: 2}); !errors.Is(err, ErrMalformedRecords) {
+		t.Fatalf("expected ErrMalformedRecords for a partial record, got %v", err)
+	}
+	if _, err := LoadDatabase(bytes.NewReader([]byte("1\nx\n")), &p, LoadOptions{Format: FormatCSV}); !errors.Is(err, ErrMalformedRecords) {
+		t.Fatalf("expected ErrMalformedRecords for a non-numeric value, got %v", err)
+	}
+	if _, err := LoadDatabase(bytes.NewReader([]byte("1\n2\n")), &p, LoadOptions{Format: FormatCSV}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for empty params, got %v", err)
+	}
+}
+
+// Test that updates reach clients through hint patches, for packed entries,
+// entries spread over several Z_p elements and byte records.
+func TestUpdate(t *testing.T) {
+	pir := GulliverPIR{}
+	d := uint64(1 << 12)
+	check := func(server *Server, client *Client, index, want uint64) {
+		h, q, err := client.Query(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans, err := server.Answer(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := client.Recover(h, ans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("got %d instead of %d at index %d", got, want, index)
+		}
+	}
+
+	for _, rowLength := range []uint64{2, 32} {
+		plan, err := PlanParams(d, rowLength, 1<<10, 32, 28, CostWeights{Offline: 1, Upload: 1, Download: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := plan.Params
+		vals := make([]uint64, d)
+		for i := range vals {
+			vals[i] = RandInt(new(big.Int).Lsh(big.NewInt(1), uint(rowLength))).Uint64()
+		}
+		DB := MakeDB(d, rowLength, &p, vals)
+		server, err := NewServer(&pir, DB, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, _ := server.Params()
+		hint, _ := server.Hint()
+		client, err := NewClient(&pir, params, hint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Preprocess(2); err != nil {
+			t.Fatal(err)
+		}
+
+		for k := 0; k < 4; k++ {
+			index := RandInt(new(big.Int).SetUint64(d)).Uint64()
+			vals[index] ^= 1 | uint64(1)<<(rowLength-1)
+			patch, err := server.Update(index, vals[index])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.ApplyPatch(patch); err != nil {
+				t.Fatal(err)
+			}
+			check(server, client, index, vals[index])
+			check(server, client, (index+1)%d, vals[(index+1)%d])
+		}
+		if client.Precomputed() != 0 {
+			t.Fatal("precomputed material survived a patch")
+		}
+
+		// A fresh client sees the updates in the hint.
+		hint, _ = server.Hint()
+		client, err = NewClient(&pir, params, hint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(0); i < d; i += d / 8 {
+			check(server, client, i, vals[i])
+		}
+
+		if _, err := server.Update(d, 0); !errors.Is(err, ErrIndexOutOfRange) {
+			t.Fatalf("expected ErrIndexOutOfRange, got %v", err)
+		}
+		if _, err := server.Update(0, uint64(1)<<rowLength); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("expected ErrInvalidParams for a value that does not fit, got %v", err)
+		}
+	}
+
+	// Byte records.
+	recordLen := uint64(20)
+	records := make([][]byte, 256)
+	for i := range records {
+		records[i] = bytes.Repeat([]byte{byte(i)}, int(recordLen))
+	}
+	plan, err := PlanParams(uint64(len(records)), 8*recordLen, 1<<10, 32, 28, CostWeights{Offline: 1, Upload: 1, Download: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB := MakeDBBytes(uint64(len(records)), recordLen, &plan.Params, records)
+	server, err := NewServer(&pir, DB, plan.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := []byte("an updated record...")
+	patch, err := server.UpdateBytes(7, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ApplyPatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	h, q, _ := client.Query(7)
+	ans, _ := server.Answer(q)
+	got, err := client.RecoverBytes(h, ans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, rec) {
+		t.Fatalf("got %q instead of %q", got, rec)
+	}
+	if err := client.ApplyPatch(patch[:len(patch)-1]); !errors.Is(err, ErrMalformedMsg) {
+		t.Fatalf("expected ErrMalformedMsg for a truncated patch, got %v", err)
+	}
+
+	dpir := DoublePIR{}
+	dp := dpir.PickParams(1<<10, 1<<16, 1<<10, 32, 28)
+	dDB := MakeRandomDB(1<<16, uint64(math.Log2(float64(dp.P))), &dp)
+	sdb, _, err := dpir.Setup(dDB, dpir.Init(dDB.Info, dp), dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdb.Update(0, 1); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for a DoublePIR database, got %v", err)
+	}
+}
+
+// Test that a saved server reopens from its file and keeps answering, for
+// both schemes.
+func TestServerFile(t *testing.T) {
+	d := uint64(1 << 14)
+	for _, pi := range []PIR{&GulliverPIR{}, &DoublePIR{}} {
+		p := pi.PickParams(1<<10, d, 1<<10, 32, 28)
+		DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+		server, err := NewServer(pi, DB, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := t.TempDir() + "/server.gpir"
+		if err := server.Save(path); err != nil {
+			t.Fatal(err)
+		}
+
+		opened, err := OpenServer(pi, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, _ := opened.Params()
+		hint, _ := opened.Hint()
+		if want, _ := server.Hint(); !bytes.Equal(hint, want) {
+			t.Fatalf("%s: hint differs after reopening", pi.Name())
+		}
+		client, err := NewClient(pi, params, hint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := RandInt(new(big.Int).SetUint64(d)).Uint64()
+		want := DB.GetElem(index)
+		if _, ok := pi.(*GulliverPIR); ok {
+			// Updates work on the private mapping.
+			want = (want + 1) % p.P
+			patch, err := opened.Update(index, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.ApplyPatch(patch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h, q, err := client.Query(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans, err := opened.Answer(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := client.Recover(h, ans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s: got %d instead of %d at index %d", pi.Name(), got, want, index)
+		}
+		if err := opened.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Matrix dimensions that overflow are rejected, not sliced.
+		if _, ok := pi.(*GulliverPIR); ok {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Skip the magic, parameters, counts, size and per-level info.
+			pos := len(serverFileMagic)
+			pos += 8 + int(binary.LittleEndian.Uint64(raw[pos:]))
+			levels := int(binary.LittleEndian.Uint32(raw[pos+4:]))
+			table := pos + 8 + 8 + levels*binary.Size(DBinfo{})
+			for _, dims := range [][2]uint64{{math.MaxUint64 - 3, 1}, {1 << 62, 4}, {1, math.MaxUint64}} {
+				bad := append([]byte(nil), raw...)
+				binary.LittleEndian.PutUint64(bad[table:], dims[0])
+				binary.LittleEndian.PutUint64(bad[table+8:], dims[1])
+				badPath := t.TempDir() + "/bad.gpir"
+				if err := os.WriteFile(badPath, bad, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := OpenServer(pi, badPath); !errors.Is(err, ErrMalformedMsg) {
+					t.Fatalf("expected ErrMalformedMsg for a %d-by-%d matrix, got %v", dims[0], dims[1], err)
+				}
+			}
+		}
+
+		if _, err := OpenServer(&DoublePIR{}, path); pi.Name() != "DoublePIR" && !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("expected ErrInvalidParams for the wrong scheme, got %v", err)
+		}
+
+		// A truncated file is rejected.
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data[:len(data)/2], 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenServer(pi, path); !errors.Is(err, ErrMalformedMsg) {
+			t.Fatalf("expected ErrMalformedMsg for a truncated file, got %v", err)
+		}
+	}
+}
+
+// Test that sharded servers, local or remote, answer exactly like a single
+// server.
+func TestShards(t *testing.T) {
+	pir := GulliverPIR{}
+	d := uint64(1 << 16)
+	p := pir.PickParams(1<<10, d, 1<<10, 32, 28)
+	DB := MakeRandomDB(d, uint64(math.Log2(float64(p.P))), &p)
+	server, err := NewServer(&pir, DB, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, q, err := client.Query(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := server.Answer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := server.Shards(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows uint64
+	for _, sh := range shards {
+		if sh.From != rows || sh.From%shardAlign != 0 {
+			t.Fatalf("shard starts at row %d, expected %d", sh.From, rows)
+		}
+		rows += sh.Rows()
+	}
+	if len(shards) != 3 || rows != p.L {
+		t.Fatalf("%d shards cover %d rows of %d", len(shards), rows, p.L)
+	}
+	// The packed kernels read up to a block of rows past the end of a shard,
+	// so every shard, including the last, needs that room as capacity.
+	checkSpareRows := func() {
+		for i, sh := range shards[:3] {
+			if room := uint64(cap(sh.data.Data)); room < (sh.Rows()+shardAlign)*sh.data.Cols {
+				t.Fatalf("shard %d has room for %d entries, expected %d", i, room, (sh.Rows()+shardAlign)*sh.data.Cols)
+			}
+		}
+	}
+	checkSpareRows()
+
+	// Serve the last shard over TCP from its encoding.
+	enc, err := shards[2].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remote Shard
+	if err := remote.UnmarshalBinary(enc); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeShard(l, &remote)
+	peer, err := DialShard("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	server.SetShards([]ShardWorker{shards[0], shards[1], peer})
+	got, err := server.Answer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("sharded answer differs from the unsharded one")
+	}
+
+	// Local shards see updates.
+	patch, err := server.Update(0, (DB.GetElem(0)+1)%p.P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ApplyPatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	checkSpareRows()
+	h, q, _ := client.Query(0)
+	ans, err := server.Answer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := client.Recover(h, ans); err != nil || val != (DB.GetElem(0)+1)%p.P {
+		t.Fatalf("got %d (%v) instead of %d after an update", val, err, (DB.GetElem(0)+1)%p.P)
+	}
+
+	if _, err := server.Shards(0); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for zero shards, got %v", err)
+	}
+}
+
+// Test that DBBuilder lays out records exactly like MakeDB, whichever way
+// they are added.
+func TestDBBuilder(t *testing.T) {
+	num := uint64(5000)
+	for _, rowLength := range []uint64{3, 16, 40} {
+		plan, err := PlanParams(num, rowLength, 1<<10, 32, 28, CostWeights{Offline: 1, Upload: 1, Download: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := plan.Params
+		vals := make([]uint64, num)
+		var raw bytes.Buffer
+		rec := make([]byte, (rowLength+7)/8)
+		for i := range vals {
+			vals[i] = RandInt(new(big.Int).Lsh(big.NewInt(1), uint(rowLength))).Uint64()
+			v := vals[i]
+			for j := len(rec) - 1; j >= 0; j-- {
+				rec[j] = byte(v)
+				v >>= 8
+			}
+			raw.Write(rec)
+		}
+		want := MakeDB(num, rowLength, &p, vals)
+
+		built := make([]*Database, 3)
+		for k := range built {
+			b, err := NewDBBuilder(num, rowLength, &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch k {
+			case 0:
+				for _, v := range vals[:num/2] {
+					if err := b.Add(v); err != nil {
+						t.Fatal(err)
+					}
+				}
+				i := num / 2
+				err = b.AddAll(func() (uint64, bool) {
+					if i == num {
+						return 0, false
+					}
+					i++
+					return vals[i-1], true
+				})
+			case 1:
+				_, err = b.ReadFrom(bytes.NewReader(raw.Bytes()))
+			case 2:
+				for i := uint64(0); i < num && err == nil; i++ {
+					err = b.AddBytes(raw.Bytes()[i*uint64(len(rec)) : (i+1)*uint64(len(rec))])
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if built[k], err = b.Finish(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for k, DB := range built {
+			for i := range want.Data.Data {
+				if DB.Data.Data[i] != want.Data.Data[i] {
+					t.Fatalf("row length %d, builder %d: entry %d differs from MakeDB", rowLength, k, i)
+				}
+			}
+		}
+
+		b, _ := NewDBBuilder(num, rowLength, &p)
+		if err := b.Add(uint64(1) << rowLength); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("expected ErrInvalidParams for a value that does not fit, got %v", err)
+		}
+		if _, err := b.Finish(); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("expected ErrInvalidParams for a database with missing records, got %v", err)
+		}
+		if len(rec) > 1 {
+			if _, err := b.ReadFrom(bytes.NewReader(raw.Bytes()[:2*len(rec)-1])); !errors.Is(err, ErrMalformedRecords) {
+				t.Fatalf("expected ErrMalformedRecords for a truncated record, got %v", err)
+			}
+		}
+		b.AddAll(func() (uint64, bool) { return 0, b.Added() < num })
+		if err := b.Add(0); !errors.Is(err, ErrIndexOutOfRange) {
+			t.Fatalf("expected ErrIndexOutOfRange for too many records, got %v", err)
+		}
+	}
+}
+
+// Test that variable-length records come back exactly, including empty ones
+// and ones spread over several slots.
+func TestVarRecords(t *testing.T) {
+	pir := GulliverPIR{}
+	slotLen, maxSlots := uint64(64), uint64(5)
+	records := make([][]byte, 300)
+	for i := range records {
+		records[i] = make([]byte, (i*37)%(int(slotLen*maxSlots)-varLenPrefix+1))
+		for j := range records[i] {
+			records[i][j] = byte(i + j)
+		}
+	}
+	records[3] = []byte{0, 0, 0} // trailing zeros are kept
+
+	num, err := VarSlots(slotLen, maxSlots, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanParams(num, 8*slotLen, 1<<10, 32, 28, CostWeights{Offline: 1, Upload: 1, Download: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB, layout, err := NewVarDatabase(slotLen, maxSlots, &plan.Params, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.NumSlots() != num || layout.NumRecords() != uint64(len(records)) {
+		t.Fatalf("layout has %d slots for %d records", layout.NumSlots(), layout.NumRecords())
+	}
+
+	enc, _ := layout.MarshalBinary()
+	var decoded VarLayout
+	if err := decoded.UnmarshalBinary(enc); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&pir, DB, plan.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := server.Params()
+	hint, _ := server.Hint()
+	client, err := NewClient(&pir, params, hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := 0
+	answer := func(q []byte) ([]byte, error) {
+		queries++
+		return server.Answer(q)
+	}
+	for _, i := range []uint64{0, 3, 9, 100, 299} {
+		got, err := client.FetchVar(&decoded, i, answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, records[i]) {
+			t.Fatalf("record %d: got %d bytes instead of %d", i, len(got), len(records[i]))
+		}
+	}
+	if queries != 5*int(maxSlots) {
+		t.Fatalf("expected %d queries, got %d", 5*maxSlots, queries)
+	}
+
+	if _, err := VarSlots(slotLen, 1, records); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams for records that need spreading, got %v", err)
+	}
+	if err := decoded.UnmarshalBinary(enc[:len(enc)-1]); !errors.Is(err, ErrMalformedMsg) {
+		t.Fatalf("expected ErrMalformedMsg for a truncated layout, got %v", err)
+	}
+}
+
+// Test that records appended to reserved slots are retrievable by clients
+// that only apply the hint patches.
+func TestAppend(t *testing.T) {
+	pir := GulliverPIR{}
+	capacity, used := uint64(1<<10), uint64(700)
+	for _, rowLength := range []uint64{4, 40} {
+		plan, err := PlanParams(capacity, rowLength, 1<<10, 32, 28, CostWeights{Offline: 1, Upload: 1, Download: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := plan.Params
+		b, err := NewDBBuilder(capacity, rowLength, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals := make([]uint64, capacity)
+		for i := range vals {
+			vals[i] = RandInt(new(big.Int).SetUint64(1 << rowLength)).Uint64()
+			if uint64(i) < used {
+				if err := b.Add(vals[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		DB, err := b.FinishReserved()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if DB.Len() != used || DB.GetElem(used) != 0 {
+			t.Fatalf("reserved database has %d records in use, slot %d is %d", DB.Len(), used, DB.GetElem(used))
+		}
+
+		server, err := NewServer(&pir, DB, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, _ := server.Params()
+		hint, _ := server.Hint()
+		client, err := NewClient(&pir, params, hint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Update(used, 1); !errors.Is(err, ErrIndexOutOfRange) {
+			t.Fatalf("expected ErrIndexOutOfRange for a reserved slot, got %v", err)
+		}
+		for i := used; i < capacity; i++ {
+			index, patch, err := server.Append(vals[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index != i {
+				t.Fatalf("appended record %d at index %d", i, index)
+			}
+			if err := client.ApplyPatch(patch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := server.Append(0); !errors.Is(err, ErrCapacityExhausted) {
+			t.Fatalf("expected ErrCapacityExhausted, got %v", err)
+		}
+		if server.Len() != capacity || server.Capacity() != capacity {
+			t.Fatalf("server has %d of %d records in use", server.Len(), server.Capacity())
+		}
+
+		for _, index := range []uint64{0, used - 1, used, capacity - 1} {
+			h, q, err := client.Query(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ans, err := server.Answer(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := client.Recover(h, ans)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != vals[index] {
+				t.Fatalf("row length %d: got %d instead of %d at index %d", rowLength, got, vals[index], index)
+			}
+		}
+
+		path := t.TempDir() + "/server.gpir"
+		if err := server.Save(path); err != nil {
+			t.Fatal(err)
+		}
+		opened, err := OpenServer(&pir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened.Len() != capacity {
+			t.Fatalf("reopened server has %d records in use", opened.Len())
+		}
+		opened.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package pir
+
+import (
+	"fmt"
+	"math"
+)
+
+// CostWeights weigh the three kinds of communication when planning a
+// database shape. Setting Offline to a small value models a hint that is
+// amortized over many queries.
+type CostWeights struct {
+	Offline  float64 // weight of the hint, downloaded once
+	Upload   float64 // weight of a query
+	Download float64 // weight of an answer
+}
+
+// Plan is a database shape chosen by PlanParams, with the communication it
+// is predicted to cost.
+type Plan struct {
+	Params Params
+	Ne     uint64 // Z_p elements per record
+
+	OfflineBytes  uint64 // size of the hint, L×N elements of Z_Q
+	UploadBytes   uint64 // size of a query, M elements of Z_q padded for squishing
+	DownloadBytes uint64 // size of an answer, L elements of Z_q
+	Cost          float64
+}
+
+// planSteps is the number of candidate widths tried per doubling of M.
+const planSteps = 16
+
+// commBytes returns the size in bytes of size elements of logMod bits.
+func commBytes(size, logMod uint64) uint64 {
+	return (size*logMod + 7) / 8
+}
+
+// planWidths returns the candidate database widths, multiples of the squish
+// compression from squishCompression up to max, spaced geometrically.
+func planWidths(max uint64) []uint64 {
+	var out []uint64
+	for x := 0.0; ; x++ {
+		m := uint64(math.Ceil(math.Exp2(x/planSteps)/squishCompression)) * squishCompression
+		if len(out) == 0 || m > out[len(out)-1] {
+			out = append(out, m)
+		}
+		if m >= max {
+			return out
+		}
+	}
+}
+
+// PlanParams picks the database shape for numRecords records of recordBits
+// bits each and secret dimension n that minimizes the weighted communication
+// cost. It searches the width M among multiples of the squish compression,
+// picks P for every width like PickParams does, and takes the smallest height
+// L that is a multiple of the number of Z_p elements per record and holds
+// the whole database.
+func PlanParams(numRecords, recordBits, n, logQ, logq uint64, w CostWeights) (Plan, error) {
+	if numRecords == 0 || recordBits == 0 || logq > logQ {
+		return Plan{}, fmt.Errorf("%w: %d records of %d bits, logQ=%d, logq=%d",
+			ErrInvalidParams, numRecords, recordBits, logQ, logq)
+	}
+	base := Params{N: n, LogQ: logQ, Logq: logq, Uniform: uint64(1) << (logQ - logq)}
+	if logQ > elemBits {
+		base.ElemBits = 64
+	}
+
+	var best Plan
+	found := false
+	for _, m := range planWidths(numRecords) {
+		p := base
+		p.M = m
+		p.P = pickPlaintextModulus(p, defaultLogFailure)
+		elems, ne, _ := Num_DB_entries(numRecords, recordBits, p.P)
+		groups := (elems/ne + m - 1) / m
+		p.L = groups * ne
+		if p.Validate(recordBits, numRecords) != nil {
+			continue
+		}
+
+		plan := Plan{
+			Params:        p,
+			Ne:            ne,
+			OfflineBytes:  commBytes(p.L*p.N, p.LogQ),
+			UploadBytes:   commBytes(p.M, p.Logq),
+			DownloadBytes: commBytes(p.L, p.Logq),
+		}
+		plan.Cost = w.Offline*float64(plan.OfflineBytes) + w.Upload*float64(plan.UploadBytes) +
+			w.Download*float64(plan.DownloadBytes)
+		if !found || plan.Cost < best.Cost {
+			best, found = plan, true
+		}
+	}
+	if !found {
+		return Plan{}, fmt.Errorf("%w: no database shape holds %d records of %d bits",
+			ErrInvalidParams, numRecords, recordBits)
+	}
+	return best, nil
+}
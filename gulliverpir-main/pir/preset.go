@@ -0,0 +1,197 @@
+package pir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// Preset is a named, versioned set of vetted parameters. It fixes everything
+// but the database shape, which Params derives from the database size,
+// including the secret distribution its security estimate assumes and the
+// element width. The preset guarantees a per-element failure probability of at most
+// 2^defaultLogFailure for databases up to MaxM columns wide. Its JSON
+// encoding is canonical, as encoding/json emits the fields in order.
+type Preset struct {
+	Name    string `json:"name"`
+	Version uint64 `json:"version"`
+
+	N       uint64 `json:"n"`
+	LogQ    uint64 `json:"log_Q"`
+	Logq    uint64 `json:"log_q"`
+	Uniform uint64 `json:"uniform"`
+	P       uint64 `json:"p"`
+
+	Secret      SecretDist `json:"secret"`
+	SecretParam uint64     `json:"secret_param"`
+	ElemBits    uint64     `json:"elem_bits"`
+
+	Basis     uint64 `json:"basis"`
+	Squishing uint64 `json:"squishing"`
+	MaxM      uint64 `json:"max_m"`
+}
+
+// presets holds the registered presets by name.
+var presets = map[string]Preset{}
+
+func init() {
+	for _, p := range []Preset{
+		// Matches the parameters used throughout the tests. It is estimated
+		// at about 90 bits of security and meant for benchmarks only.
+		{Name: "n1024-p1024-v1", Version: 1, N: 1 << 10, LogQ: 32, Logq: 28, Uniform: 16, P: 1 << 10,
+			Secret: SecretUniform, ElemBits: 32, Basis: squishBasis, Squishing: squishCompression, MaxM: 1 << 13},
+		// At least 128 bits of security.
+		{Name: "n2048-p1024-v1", Version: 1, N: 1 << 11, LogQ: 32, Logq: 28, Uniform: 16, P: 1 << 10,
+			Secret: SecretUniform, ElemBits: 32, Basis: squishBasis, Squishing: squishCompression, MaxM: 1 << 13},
+		// At least 128 bits of security, with a smaller plaintext modulus
+		// that leaves room for wider databases.
+		{Name: "n2048-p256-v1", Version: 1, N: 1 << 11, LogQ: 32, Logq: 28, Uniform: 16, P: 1 << 8,
+			Secret: SecretUniform, ElemBits: 32, Basis: squishBasis, Squishing: squishCompression, MaxM: 1 << 20},
+	} {
+		if err := RegisterPreset(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterPreset adds p to the registry. Names are unique; a new version of
+// a preset must be registered under a new name.
+func RegisterPreset(p Preset) error {
+	if p.Name == "" {
+		return fmt.Errorf("%w: preset has no name", ErrInvalidParams)
+	}
+	if _, ok := presets[p.Name]; ok {
+		return fmt.Errorf("%w: preset %q is already registered", ErrInvalidParams, p.Name)
+	}
+	if p.ElemBits != 32 && p.ElemBits != 64 {
+		return fmt.Errorf("%w: preset %q must pin an element width of 32 or 64 bits, not %d",
+			ErrInvalidParams, p.Name, p.ElemBits)
+	}
+	basis, compression := squishSettings(p.ElemBits == 64)
+	if p.Basis != basis || p.Squishing != compression {
+		return fmt.Errorf("%w: preset %q uses basis %d and compression %d, the kernels use %d and %d",
+			ErrInvalidParams, p.Name, p.Basis, p.Squishing, basis, compression)
+	}
+	if _, err := p.Params(1); err != nil {
+		return fmt.Errorf("preset %q: %w", p.Name, err)
+	}
+	presets[p.Name] = p
+	return nil
+}
+
+// LookupPreset returns the registered preset called name.
+func LookupPreset(name string) (Preset, error) {
+	p, ok := presets[name]
+	if !ok {
+		return Preset{}, fmt.Errorf("%w: unknown preset %q", ErrInvalidParams, name)
+	}
+	return p, nil
+}
+
+// PresetNames returns the names of all registered presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Params returns the parameters of the preset for a database of d Z_p
+// elements, laid out like PickParams does, and validates them.
+func (p *Preset) Params(d uint64) (Params, error) {
+	l, m := ApproxSquareDatabase(d)
+	if m > p.MaxM {
+		return Params{}, fmt.Errorf("%w: preset %q supports at most %d columns, need %d",
+			ErrInvalidParams, p.Name, p.MaxM, m)
+	}
+	out := Params{N: p.N, Uniform: p.Uniform, Secret: p.Secret, SecretParam: p.SecretParam,
+		L: l, M: m, LogQ: p.LogQ, Logq: p.Logq, P: p.P, ElemBits: p.ElemBits}
+	if err := out.Validate(uint64(bits.Len64(p.P))-1, d); err != nil {
+		return Params{}, err
+	}
+	return out, nil
+}
+
+const presetMagic = "GPIRPS02"
+
+// fields lists the numeric fields of p in their canonical order.
+func (p *Preset) fields() []*uint64 {
+	return []*uint64{&p.Version, &p.N, &p.LogQ, &p.Logq, &p.Uniform, &p.P,
+		(*uint64)(&p.Secret), &p.SecretParam, &p.ElemBits, &p.Basis, &p.Squishing, &p.MaxM}
+}
+
+// MarshalBinary encodes the preset canonically: the magic, the length of
+// the name (uint32) and the name, then every numeric field as a
+// little-endian uint64.
+func (p *Preset) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(presetMagic)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(p.Name)))
+	buf.Write(n[:])
+	buf.WriteString(p.Name)
+	var b [8]byte
+	for _, v := range p.fields() {
+		binary.LittleEndian.PutUint64(b[:], *v)
+		buf.Write(b[:])
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a preset encoded by MarshalBinary.
+func (p *Preset) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(presetMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != presetMagic {
+		return fmt.Errorf("%w: not an encoding of a preset", ErrMalformedMsg)
+	}
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return fmt.Errorf("%w: truncated preset", ErrMalformedMsg)
+	}
+	nameLen := binary.LittleEndian.Uint32(n[:])
+	if uint64(nameLen) > uint64(r.Len()) {
+		return fmt.Errorf("%w: truncated preset name", ErrMalformedMsg)
+	}
+	name := make([]byte, nameLen)
+	io.ReadFull(r, name)
+
+	out := Preset{Name: string(name)}
+	var b [8]byte
+	for _, v := range out.fields() {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return fmt.Errorf("%w: truncated preset", ErrMalformedMsg)
+		}
+		*v = binary.LittleEndian.Uint64(b[:])
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after preset", ErrMalformedMsg, r.Len())
+	}
+	*p = out
+	return nil
+}
+
+// Fingerprint returns the SHA-256 hash of the canonical binary encoding.
+func (p *Preset) Fingerprint() [sha256.Size]byte {
+	enc, _ := p.MarshalBinary()
+	return sha256.Sum256(enc)
+}
+
+// MatchPreset looks up the preset called name and ensures that it has the
+// given fingerprint, i.e. that both sides agree on every parameter.
+func MatchPreset(name string, fingerprint [sha256.Size]byte) (Preset, error) {
+	p, err := LookupPreset(name)
+	if err != nil {
+		return Preset{}, err
+	}
+	if p.Fingerprint() != fingerprint {
+		return Preset{}, fmt.Errorf("%w: fingerprint of preset %q does not match", ErrInvalidParams, name)
+	}
+	return p, nil
+}
@@ -25,6 +25,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math/big"
 	mrand "math/rand"
@@ -116,11 +117,20 @@ func NewBufPRG(prg *PRGReader) *BufPRGReader {
 	return out
 }
 
-func (b *BufPRGReader) RandInt(mod *big.Int) *big.Int {
+// Int returns a random integer in Z_mod, or ErrRandomness if the
+// stream could not be read or mod is not positive.
+func (b *BufPRGReader) Int(mod *big.Int) (*big.Int, error) {
 	out, err := rand.Int(b.stream, mod)
 	if err != nil {
-		// TODO: Replace this with non-absurd error handling.
-		panic("Catastrophic randomness failure!")
+		return nil, fmt.Errorf("%w: %v", ErrRandomness, err)
+	}
+	return out, nil
+}
+
+func (b *BufPRGReader) RandInt(mod *big.Int) *big.Int {
+	out, err := b.Int(mod)
+	if err != nil {
+		panic(err)
 	}
 	return out
 }
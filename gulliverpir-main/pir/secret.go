@@ -0,0 +1,127 @@
+package pir
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+// SecretDist selects the distribution of the LWR secret. Narrower secrets
+// lower the security estimate, which only depends on the secret through its
+// standard deviation; decoding subtracts H·s exactly, so correctness does not
+// depend on the secret at all.
+type SecretDist uint64
+
+const (
+	// SecretUniform samples uniformly from [-Uniform/2, Uniform/2).
+	SecretUniform SecretDist = iota
+	// SecretTernary samples uniformly from {-1, 0, 1}.
+	SecretTernary
+	// SecretBinary samples uniformly from {0, 1}.
+	SecretBinary
+	// SecretBinomial samples from the centred binomial distribution with
+	// parameter SecretParam, i.e. the difference of two sums of
+	// SecretParam coin flips.
+	SecretBinomial
+	// SecretHammingWeight samples ternary secrets with exactly SecretParam
+	// non-zero entries.
+	SecretHammingWeight
+)
+
+func (d SecretDist) String() string {
+	switch d {
+	case SecretUniform:
+		return "uniform"
+	case SecretTernary:
+		return "ternary"
+	case SecretBinary:
+		return "binary"
+	case SecretBinomial:
+		return "binomial"
+	case SecretHammingWeight:
+		return "hamming-weight"
+	}
+	return fmt.Sprintf("SecretDist(%d)", uint64(d))
+}
+
+// maxBinomial bounds the parameter of the centred binomial distribution, so
+// that both sums come from a single 64-bit sample.
+const maxBinomial = 32
+
+// checkSecret reports the violations of the secret distribution settings.
+func (p *Params) checkSecret(add func(field string, value uint64, format string, args ...interface{})) {
+	switch p.Secret {
+	case SecretUniform:
+		if p.Uniform == 0 {
+			add("Uniform", p.Uniform, "must be positive for uniform secrets")
+		}
+	case SecretTernary, SecretBinary:
+	case SecretBinomial:
+		if p.SecretParam == 0 || p.SecretParam > maxBinomial {
+			add("SecretParam", p.SecretParam, "must be in [1, %d] for binomial secrets", maxBinomial)
+		}
+	case SecretHammingWeight:
+		if p.SecretParam == 0 || p.SecretParam > p.N {
+			add("SecretParam", p.SecretParam, "must be in [1, N=%d] for fixed-weight secrets", p.N)
+		}
+	default:
+		add("Secret", uint64(p.Secret), "is not a known secret distribution")
+	}
+}
+
+// secretStdDev returns the standard deviation of an entry of the secret.
+func (p *Params) secretStdDev() float64 {
+	switch p.Secret {
+	case SecretTernary:
+		return math.Sqrt(2.0 / 3)
+	case SecretBinary:
+		return 0.5
+	case SecretBinomial:
+		return math.Sqrt(float64(p.SecretParam) / 2)
+	case SecretHammingWeight:
+		return math.Sqrt(float64(p.SecretParam) / float64(p.N))
+	}
+	u := float64(p.Uniform)
+	return math.Sqrt((u*u - 1) / 12)
+}
+
+// sampleSecret samples an N-by-1 secret from the distribution selected by p,
+// with the element width of p. Negative entries wrap around.
+func sampleSecret(p Params) *Matrix {
+	s := MatrixNewWidth(p.N, 1, p.wide())
+	switch p.Secret {
+	case SecretTernary:
+		for i := uint64(0); i < p.N; i++ {
+			s.Set(RandInt(big.NewInt(3)).Uint64()-1, i, 0)
+		}
+	case SecretBinary:
+		for i := uint64(0); i < p.N; i++ {
+			s.Set(RandInt(big.NewInt(2)).Uint64(), i, 0)
+		}
+	case SecretBinomial:
+		mod := new(big.Int).Lsh(big.NewInt(1), uint(2*p.SecretParam))
+		for i := uint64(0); i < p.N; i++ {
+			coins := RandInt(mod).Uint64()
+			pos := bits.OnesCount64(coins & (uint64(1)<<p.SecretParam - 1))
+			neg := bits.OnesCount64(coins >> p.SecretParam)
+			s.Set(uint64(pos-neg), i, 0)
+		}
+	case SecretHammingWeight:
+		// Draw the support with a partial Fisher-Yates shuffle.
+		idx := make([]uint64, p.N)
+		for i := range idx {
+			idx[i] = uint64(i)
+		}
+		for k := uint64(0); k < p.SecretParam; k++ {
+			j := k + RandInt(new(big.Int).SetUint64(p.N-k)).Uint64()
+			idx[k], idx[j] = idx[j], idx[k]
+			s.Set(2*RandInt(big.NewInt(2)).Uint64()-1, idx[k], 0)
+		}
+	default:
+		for i := uint64(0); i < p.N; i++ {
+			s.Set(RandInt(new(big.Int).SetUint64(p.Uniform)).Uint64()-p.Uniform/2, i, 0)
+		}
+	}
+	return s
+}
@@ -0,0 +1,244 @@
+package pir
+
+// #cgo CFLAGS: -O3 -march=native
+// #include "pir.h"
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Wire format: all integers are little-endian. A matrix is encoded as its
+// number of rows and columns (uint64 each) and the width of its entries in
+// bytes (uint32, 4 or 8 for wide matrices), followed by its entries, row by
+// row. A Msg is a uint32 count followed by its matrices.
+
+const (
+	elemBytes   = 4
+	elemBytes64 = 8
+	matrixHdr   = 20
+)
+
+// MarshalBinary encodes the matrix in the wire format.
+func (m *Matrix) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a matrix encoded by MarshalBinary.
+func (m *Matrix) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := m.readFrom(r); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after matrix", ErrMalformedMsg, r.Len())
+	}
+	return nil
+}
+
+func (m *Matrix) writeTo(buf *bytes.Buffer) {
+	var hdr [matrixHdr]byte
+	binary.LittleEndian.PutUint64(hdr[0:], m.Rows)
+	binary.LittleEndian.PutUint64(hdr[8:], m.Cols)
+	if m.Wide {
+		binary.LittleEndian.PutUint32(hdr[16:], elemBytes64)
+	} else {
+		binary.LittleEndian.PutUint32(hdr[16:], elemBytes)
+	}
+	buf.Write(hdr[:])
+
+	if m.Wide {
+		var b [elemBytes64]byte
+		for _, v := range m.Data64[:m.Rows*m.Cols] {
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			buf.Write(b[:])
+		}
+		return
+	}
+	var b [elemBytes]byte
+	for _, v := range m.Data[:m.Rows*m.Cols] {
+		binary.LittleEndian.PutUint32(b[:], uint32(v))
+		buf.Write(b[:])
+	}
+}
+
+func (m *Matrix) readFrom(r *bytes.Reader) error {
+	var hdr [matrixHdr]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return fmt.Errorf("%w: truncated matrix header", ErrMalformedMsg)
+	}
+	rows := binary.LittleEndian.Uint64(hdr[0:])
+	cols := binary.LittleEndian.Uint64(hdr[8:])
+	width := uint64(binary.LittleEndian.Uint32(hdr[16:]))
+	if width != elemBytes && width != elemBytes64 {
+		return fmt.Errorf("%w: unsupported entry width of %d bytes", ErrMalformedMsg, width)
+	}
+
+	// Check the size against the remaining input before allocating.
+	if cols != 0 && rows > uint64(r.Len())/width/cols {
+		return fmt.Errorf("%w: %d-by-%d matrix does not fit in %d bytes", ErrMalformedMsg, rows, cols, r.Len())
+	}
+	out := MatrixNewWidth(rows, cols, width == elemBytes64)
+	b := make([]byte, width)
+	for i := uint64(0); i < rows*cols; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("%w: truncated matrix data", ErrMalformedMsg)
+		}
+		if out.Wide {
+			out.Data64[i] = C.Elem64(binary.LittleEndian.Uint64(b))
+		} else {
+			out.Data[i] = C.Elem(binary.LittleEndian.Uint32(b))
+		}
+	}
+	*m = *out
+	return nil
+}
+
+// MarshalBinary encodes the message in the wire format.
+func (m *Msg) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(m.Data)))
+	buf.Write(n[:])
+	for _, d := range m.Data {
+		d.writeTo(&buf)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary.
+func (m *Msg) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return fmt.Errorf("%w: truncated message header", ErrMalformedMsg)
+	}
+	count := binary.LittleEndian.Uint32(n[:])
+	// Every matrix takes at least its header.
+	if uint64(count) > uint64(r.Len())/matrixHdr {
+		return fmt.Errorf("%w: %d matrices do not fit in %d bytes", ErrMalformedMsg, count, r.Len())
+	}
+	out := Msg{Data: make([]*Matrix, count)}
+	for i := range out.Data {
+		out.Data[i] = new(Matrix)
+		if err := out.Data[i].readFrom(r); err != nil {
+			return err
+		}
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after message", ErrMalformedMsg, r.Len())
+	}
+	*m = out
+	return nil
+}
+
+// PublicParams holds everything a client needs, besides the hint, to query
+// a database: the scheme, its parameters, the layout of the preprocessed
+// database and the seed of the shared state.
+type PublicParams struct {
+	Scheme string
+	Params Params
+	Info   DBinfo
+	Seed   PRGKey
+}
+
+const publicParamsMagic = "GPIRPP03"
+
+// MarshalBinary encodes the public parameters. Params and DBinfo are written
+// field by field as little-endian uint64 values.
+func (pp *PublicParams) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(publicParamsMagic)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(pp.Scheme)))
+	buf.Write(n[:])
+	buf.WriteString(pp.Scheme)
+	if err := binary.Write(&buf, binary.LittleEndian, &pp.Params); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, &pp.Info); err != nil {
+		return nil, err
+	}
+	buf.Write(pp.Seed[:])
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes public parameters encoded by MarshalBinary.
+func (pp *PublicParams) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(publicParamsMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != publicParamsMagic {
+		return fmt.Errorf("%w: not an encoding of public parameters", ErrMalformedMsg)
+	}
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return fmt.Errorf("%w: truncated public parameters", ErrMalformedMsg)
+	}
+	nameLen := binary.LittleEndian.Uint32(n[:])
+	if uint64(nameLen) > uint64(r.Len()) {
+		return fmt.Errorf("%w: truncated scheme name", ErrMalformedMsg)
+	}
+	name := make([]byte, nameLen)
+	io.ReadFull(r, name)
+
+	var out PublicParams
+	out.Scheme = string(name)
+	if err := binary.Read(r, binary.LittleEndian, &out.Params); err != nil {
+		return fmt.Errorf("%w: truncated params", ErrMalformedMsg)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &out.Info); err != nil {
+		return fmt.Errorf("%w: truncated database info", ErrMalformedMsg)
+	}
+	if _, err := io.ReadFull(r, out.Seed[:]); err != nil {
+		return fmt.Errorf("%w: truncated seed", ErrMalformedMsg)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after public parameters", ErrMalformedMsg, r.Len())
+	}
+	*pp = out
+	return nil
+}
+
+const hintPatchMagic = "GPIRHP01"
+
+// MarshalBinary encodes the patch as its column (uint64), the number of
+// changed rows (uint32), and a row index and a delta (uint64 each) per row.
+func (h *HintPatch) MarshalBinary() ([]byte, error) {
+	if len(h.Rows) != len(h.Deltas) {
+		return nil, fmt.Errorf("%w: patch has %d rows and %d deltas", ErrMalformedMsg, len(h.Rows), len(h.Deltas))
+	}
+	hdr := len(hintPatchMagic) + 12
+	buf := make([]byte, hdr+16*len(h.Rows))
+	copy(buf, hintPatchMagic)
+	binary.LittleEndian.PutUint64(buf[len(hintPatchMagic):], h.Col)
+	binary.LittleEndian.PutUint32(buf[len(hintPatchMagic)+8:], uint32(len(h.Rows)))
+	for k := range h.Rows {
+		binary.LittleEndian.PutUint64(buf[hdr+16*k:], h.Rows[k])
+		binary.LittleEndian.PutUint64(buf[hdr+16*k+8:], h.Deltas[k])
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a patch encoded by MarshalBinary.
+func (h *HintPatch) UnmarshalBinary(data []byte) error {
+	hdr := len(hintPatchMagic) + 12
+	if len(data) < hdr || string(data[:len(hintPatchMagic)]) != hintPatchMagic {
+		return fmt.Errorf("%w: not an encoding of a hint patch", ErrMalformedMsg)
+	}
+	col := binary.LittleEndian.Uint64(data[len(hintPatchMagic):])
+	count := uint64(binary.LittleEndian.Uint32(data[len(hintPatchMagic)+8:]))
+	if uint64(len(data)-hdr) != 16*count {
+		return fmt.Errorf("%w: hint patch of %d rows has %d bytes", ErrMalformedMsg, count, len(data))
+	}
+	out := HintPatch{Col: col, Rows: make([]uint64, count), Deltas: make([]uint64, count)}
+	for k := uint64(0); k < count; k++ {
+		out.Rows[k] = binary.LittleEndian.Uint64(data[hdr+16*int(k):])
+		out.Deltas[k] = binary.LittleEndian.Uint64(data[hdr+16*int(k)+8:])
+	}
+	*h = out
+	return nil
+}
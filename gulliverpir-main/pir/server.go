@@ -0,0 +1,189 @@
+package pir
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Server is the server side of a PIR scheme, counterpart of Client. It sets
+// up the database once and then answers encoded queries. A Server is safe for
+// concurrent use.
+type Server struct {
+	pi     PIR
+	db     *ServerDB
+	shared State
+	params PublicParams
+
+	mu      sync.RWMutex // guards hint, workers and size
+	hint    Msg
+	workers []ShardWorker // shards that answer queries, if set
+	size    uint64        // records in use; the rest are reserved for Append
+
+	mapped []byte // file mapping of a server opened by OpenServer
+}
+
+// NewServer samples the shared state for scheme pi and preprocesses DB.
+func NewServer(pi PIR, DB *Database, p Params) (*Server, error) {
+	shared, comp := pi.InitCompressed(DB.Info, p)
+	db, hint, err := pi.Setup(DB, shared, p)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		pi:     pi,
+		db:     db,
+		shared: shared,
+		params: PublicParams{Scheme: pi.Name(), Params: p, Info: db.Info(), Seed: *comp.Seed},
+		hint:   hint,
+		size:   DB.Len(),
+	}, nil
+}
+
+// Params returns the encoded public parameters for NewClient.
+func (s *Server) Params() ([]byte, error) {
+	return s.params.MarshalBinary()
+}
+
+// Hint returns the encoded hint for NewClient. It reflects all updates made
+// so far.
+func (s *Server) Hint() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hint.MarshalBinary()
+}
+
+// Len returns the number of records in use.
+func (s *Server) Len() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Capacity returns the number of records the parameters have room for. Up
+// to Capacity() - Len() more records can be added with Append.
+func (s *Server) Capacity() uint64 {
+	return s.params.Info.Num
+}
+
+// Update sets record index to value, patches the server's copy of the hint
+// and returns the encoded patch, which clients apply with Client.ApplyPatch.
+func (s *Server) Update(index, value uint64) ([]byte, error) {
+	if err := s.checkInUse(index); err != nil {
+		return nil, err
+	}
+	patch, err := s.db.Update(index, value)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyPatch(patch)
+}
+
+// UpdateBytes is like Update for databases built by NewDatabaseFromBytes.
+func (s *Server) UpdateBytes(index uint64, rec []byte) ([]byte, error) {
+	if err := s.checkInUse(index); err != nil {
+		return nil, err
+	}
+	patch, err := s.db.UpdateBytes(index, rec)
+	if err != nil {
+		return nil, err
+	}
+	return s.applyPatch(patch)
+}
+
+// Append adds a record with the given value in the first reserved slot and
+// returns its index and the encoded hint patch, as Update does. Clients keep
+// their parameters and hint and only apply the patch; once all slots are in
+// use, Append fails with ErrCapacityExhausted and growing further needs new
+// parameters, and a new hint for every client.
+func (s *Server) Append(value uint64) (uint64, []byte, error) {
+	return s.append(func(index uint64) (HintPatch, error) {
+		return s.db.Update(index, value)
+	})
+}
+
+// AppendBytes is like Append for databases built from byte records.
+func (s *Server) AppendBytes(rec []byte) (uint64, []byte, error) {
+	return s.append(func(index uint64) (HintPatch, error) {
+		return s.db.UpdateBytes(index, rec)
+	})
+}
+
+func (s *Server) append(set func(index uint64) (HintPatch, error)) (uint64, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := s.size
+	if index >= s.params.Info.Num {
+		return 0, nil, fmt.Errorf("%w: all %d records are in use", ErrCapacityExhausted, s.params.Info.Num)
+	}
+	patch, err := set(index)
+	if err != nil {
+		return 0, nil, err
+	}
+	enc, err := s.applyPatchLocked(patch)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.size++
+	return index, enc, nil
+}
+
+// checkInUse ensures that record index has been set up or appended.
+func (s *Server) checkInUse(index uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if index >= s.size {
+		return fmt.Errorf("%w: record %d of %d in use", ErrIndexOutOfRange, index, s.size)
+	}
+	return nil
+}
+
+func (s *Server) applyPatch(patch HintPatch) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applyPatchLocked(patch)
+}
+
+func (s *Server) applyPatchLocked(patch HintPatch) ([]byte, error) {
+	if err := patch.Apply(s.hint, s.shared); err != nil {
+		return nil, err
+	}
+	return patch.MarshalBinary()
+}
+
+// Answer answers an encoded query built by Client.Query. If shard workers
+// are set, they all receive the query unchanged and their partial answers
+// are concatenated.
+func (s *Server) Answer(query []byte) ([]byte, error) {
+	s.mu.RLock()
+	workers := s.workers
+	s.mu.RUnlock()
+	if len(workers) > 0 {
+		return answerSharded(workers, query)
+	}
+
+	var q Msg
+	if err := q.UnmarshalBinary(query); err != nil {
+		return nil, err
+	}
+	ans, err := s.pi.Answer(s.db, MakeMsgSlice(q), s.shared, s.params.Params)
+	if err != nil {
+		return nil, err
+	}
+	return ans.MarshalBinary()
+}
+
+// SetShards makes the server answer queries with the given workers, one per
+// shard returned by ServerDB.Shards, in order. Workers serving shards of this
+// server's database in the same process see updates; remote workers serve
+// the rows they were given. Passing no workers answers locally again.
+func (s *Server) SetShards(workers []ShardWorker) {
+	s.mu.Lock()
+	s.workers = workers
+	s.mu.Unlock()
+}
+
+// Shards splits the server's database into at most k shards, see
+// ServerDB.Shards.
+func (s *Server) Shards(k int) ([]*Shard, error) {
+	return s.db.Shards(k)
+}
@@ -0,0 +1,252 @@
+package pir
+
+// #include "pir.h"
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// shardAlign is the number of rows the packed kernels process at a time.
+// Shard boundaries are multiples of it, so that no shard reads the rows of
+// another.
+const shardAlign = 8
+
+// reserveSpareRows keeps room for shardAlign more rows past the last row of
+// m as capacity of its entries, since the packed kernels may read the rest
+// of the last block. It copies the entries only if the room is missing.
+func reserveSpareRows(m *Matrix) {
+	n, pad := m.Size(), shardAlign*m.Cols
+	if m.Wide {
+		if uint64(cap(m.Data64)) < n+pad {
+			m.Data64 = append(make([]C.Elem64, 0, n+pad), m.Data64[:n]...)
+		}
+	} else if uint64(cap(m.Data)) < n+pad {
+		m.Data = append(make([]C.Elem, 0, n+pad), m.Data[:n]...)
+	}
+}
+
+// Shard is a contiguous range of rows of a squished ServerDB. Since every row
+// of the answer only depends on the matching row of the database, shards can
+// be answered independently, on the same unmodified query, and their partial
+// answers concatenated in order.
+type Shard struct {
+	From uint64 // first row of the shard
+
+	info   DBinfo
+	data   *Matrix
+	parent *ServerDB // database whose rows a local shard aliases
+}
+
+// Shards splits the database into at most k shards of consecutive rows. The
+// shards alias the database, so they see the changes made by Update, which
+// writes in place, and the room NewServerDB reserves past its last row.
+// Databases with a second-level hint, as built by DoublePIR, cannot be
+// sharded.
+func (s *ServerDB) Shards(k int) ([]*Shard, error) {
+	if k < 1 {
+		return nil, fmt.Errorf("%w: %d shards", ErrInvalidParams, k)
+	}
+	if s.hint != nil {
+		return nil, fmt.Errorf("%w: databases with a second-level hint cannot be sharded", ErrInvalidParams)
+	}
+	rows := s.data.Rows
+	size := (rows + uint64(k) - 1) / uint64(k)
+	size = (size + shardAlign - 1) / shardAlign * shardAlign
+
+	var shards []*Shard
+	for from := uint64(0); from < rows; from += size {
+		shards = append(shards, &Shard{
+			From:   from,
+			info:   s.info,
+			data:   s.data.SelectRows(from, size),
+			parent: s,
+		})
+	}
+	return shards, nil
+}
+
+// Rows returns the number of rows of the shard.
+func (sh *Shard) Rows() uint64 {
+	return sh.data.Rows
+}
+
+// Answer answers a GulliverPIR query over the rows of the shard.
+func (sh *Shard) Answer(query Msg) (Msg, error) {
+	if err := checkMsg(query.Data, 1, "query"); err != nil {
+		return Msg{}, err
+	}
+	if sh.parent != nil {
+		sh.parent.mu.RLock()
+		defer sh.parent.mu.RUnlock()
+	}
+	if err := CheckMatrixMulVecPacked(sh.data, query.Data[0], sh.info.Basis, sh.info.Squishing); err != nil {
+		return Msg{}, err
+	}
+	return MakeMsg(MatrixMulVecPacked(sh.data, query.Data[0], sh.info.Basis, sh.info.Squishing)), nil
+}
+
+// AnswerShard implements ShardWorker for a shard held in this process.
+func (sh *Shard) AnswerShard(query []byte) ([]byte, error) {
+	var q Msg
+	if err := q.UnmarshalBinary(query); err != nil {
+		return nil, err
+	}
+	ans, err := sh.Answer(q)
+	if err != nil {
+		return nil, err
+	}
+	return ans.MarshalBinary()
+}
+
+const shardMagic = "GPIRSH01"
+
+// MarshalBinary encodes the shard, e.g. to hand it to another process: the
+// first row (uint64), the DBinfo field by field, then the squished rows in
+// the wire format of matrices.
+func (sh *Shard) MarshalBinary() ([]byte, error) {
+	if sh.parent != nil {
+		sh.parent.mu.RLock()
+		defer sh.parent.mu.RUnlock()
+	}
+	var buf bytes.Buffer
+	buf.WriteString(shardMagic)
+	binary.Write(&buf, binary.LittleEndian, sh.From)
+	binary.Write(&buf, binary.LittleEndian, &sh.info)
+	sh.data.writeTo(&buf)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a shard encoded by MarshalBinary. The decoded
+// shard owns its rows and no longer follows updates of the database.
+func (sh *Shard) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(shardMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != shardMagic {
+		return fmt.Errorf("%w: not an encoding of a shard", ErrMalformedMsg)
+	}
+	var out Shard
+	if err := binary.Read(r, binary.LittleEndian, &out.From); err != nil {
+		return fmt.Errorf("%w: truncated shard", ErrMalformedMsg)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &out.info); err != nil {
+		return fmt.Errorf("%w: truncated shard", ErrMalformedMsg)
+	}
+	out.data = new(Matrix)
+	if err := out.data.readFrom(r); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after shard", ErrMalformedMsg, r.Len())
+	}
+	if out.info.Squishing == 0 || out.data.Cols*out.info.Squishing == 0 {
+		return fmt.Errorf("%w: shard is missing compression settings", ErrMalformedMsg)
+	}
+	reserveSpareRows(out.data)
+	*sh = out
+	return nil
+}
+
+// ShardWorker answers encoded queries over a single shard, in this process
+// or elsewhere.
+type ShardWorker interface {
+	AnswerShard(query []byte) ([]byte, error)
+}
+
+// answerSharded sends the unmodified query to every worker at once and
+// concatenates their partial answers in order.
+func answerSharded(workers []ShardWorker, query []byte) ([]byte, error) {
+	answers := make([]Msg, len(workers))
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(i int, w ShardWorker) {
+			defer wg.Done()
+			enc, err := w.AnswerShard(query)
+			if err == nil {
+				err = answers[i].UnmarshalBinary(enc)
+			}
+			if err == nil {
+				err = checkMsg(answers[i].Data, 1, "shard answer")
+			}
+			errs[i] = err
+		}(i, w)
+	}
+	wg.Wait()
+
+	ans := new(Matrix)
+	for i := range workers {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, errs[i])
+		}
+		ans.Concat(answers[i].Data[0])
+	}
+	out := MakeMsg(ans)
+	return out.MarshalBinary()
+}
+
+// ShardService exports a shard over net/rpc, for workers in other processes
+// or on other machines.
+type ShardService struct {
+	shard *Shard
+}
+
+// Answer answers an encoded query over the exported shard.
+func (s *ShardService) Answer(query []byte, answer *[]byte) error {
+	ans, err := s.shard.AnswerShard(query)
+	if err != nil {
+		return err
+	}
+	*answer = ans
+	return nil
+}
+
+// ServeShard answers queries over sh for every connection accepted on l,
+// until l is closed.
+func ServeShard(l net.Listener, sh *Shard) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Shard", &ShardService{shard: sh}); err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// RemoteShard is a ShardWorker served by ServeShard.
+type RemoteShard struct {
+	client *rpc.Client
+}
+
+// DialShard connects to a shard served by ServeShard at address addr.
+func DialShard(network, addr string) (*RemoteShard, error) {
+	client, err := rpc.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteShard{client: client}, nil
+}
+
+// AnswerShard implements ShardWorker.
+func (r *RemoteShard) AnswerShard(query []byte) ([]byte, error) {
+	var answer []byte
+	if err := r.client.Call("Shard.Answer", query, &answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Close closes the connection to the shard.
+func (r *RemoteShard) Close() error {
+	return r.client.Close()
+}
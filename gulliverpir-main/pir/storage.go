@@ -0,0 +1,350 @@
+package pir
+
+// #include "pir.h"
+import "C"
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+)
+
+// Server file format, written by Server.Save and read by OpenServer. All
+// integers are little-endian:
+//
+//	magic        "GPIRSV03"
+//	params       uint64 length, then the encoded PublicParams
+//	counts       uint32 number of hint matrices, uint32 number of database levels
+//	size         uint64 number of records in use, see Server.Append
+//	levels       the DBinfo of every database level, field by field as uint64
+//	matrices     rows, cols, entry width in bytes and file offset (uint64
+//	             each) of the hint matrices, then of the squished database
+//	             of every level
+//	data         the entries of every matrix, row by row, each matrix
+//	             starting at a multiple of serverFileAlign and followed by
+//	             room for shardAlign more rows, which the packed kernels
+//	             may read past the last row
+//
+// Level 0 is the database queries are answered from; level k+1 is the
+// second-level database built from the hint of level k, as by DoublePIR.
+// Since the entries are stored exactly as in memory on little-endian
+// machines, OpenServer maps them instead of reading them.
+
+const (
+	serverFileMagic = "GPIRSV03"
+	serverFileAlign = 64
+	matrixEntryHdr  = 32
+)
+
+// Save writes the server, including any updates made so far, to path. The
+// file is written to a temporary file first and then renamed, so that a
+// crash never leaves a truncated server file behind.
+func (s *Server) Save(path string) error {
+	tmp, err := os.CreateTemp(dirOf(path), ".gpir-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := s.writeTo(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func dirOf(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if os.IsPathSeparator(path[i]) {
+			return path[:i+1]
+		}
+	}
+	return "."
+}
+
+func (s *Server) writeTo(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var levels []*ServerDB
+	for db := s.db; db != nil; db = db.hint {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		levels = append(levels, db)
+	}
+
+	params, err := s.params.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var hdr bytes.Buffer
+	hdr.WriteString(serverFileMagic)
+	binary.Write(&hdr, binary.LittleEndian, uint64(len(params)))
+	hdr.Write(params)
+	binary.Write(&hdr, binary.LittleEndian, uint32(len(s.hint.Data)))
+	binary.Write(&hdr, binary.LittleEndian, uint32(len(levels)))
+	binary.Write(&hdr, binary.LittleEndian, s.size)
+	for _, db := range levels {
+		binary.Write(&hdr, binary.LittleEndian, &db.info)
+	}
+
+	mats := append([]*Matrix(nil), s.hint.Data...)
+	for _, db := range levels {
+		mats = append(mats, db.data)
+	}
+	off := alignUp(uint64(hdr.Len()) + uint64(len(mats))*matrixEntryHdr)
+	offsets := make([]uint64, len(mats))
+	for i, m := range mats {
+		offsets[i] = off
+		binary.Write(&hdr, binary.LittleEndian, [4]uint64{m.Rows, m.Cols, entryWidth(m), off})
+		off = alignUp(off + (m.Rows+shardAlign)*m.Cols*entryWidth(m))
+	}
+
+	pos := uint64(hdr.Len())
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	for i, m := range mats {
+		if err := writeZeros(w, offsets[i]-pos); err != nil {
+			return err
+		}
+		n, err := writeEntries(w, m)
+		if err != nil {
+			return err
+		}
+		pos = offsets[i] + n
+	}
+	return writeZeros(w, off-pos)
+}
+
+func writeZeros(w io.Writer, n uint64) error {
+	var zeros [serverFileAlign]byte
+	for n > 0 {
+		k := n
+		if k > serverFileAlign {
+			k = serverFileAlign
+		}
+		if _, err := w.Write(zeros[:k]); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+func alignUp(off uint64) uint64 {
+	return (off + serverFileAlign - 1) / serverFileAlign * serverFileAlign
+}
+
+func entryWidth(m *Matrix) uint64 {
+	if m.Wide {
+		return elemBytes64
+	}
+	return elemBytes
+}
+
+// writeEntries writes the entries of m in little-endian order and returns
+// the number of bytes written.
+func writeEntries(w io.Writer, m *Matrix) (uint64, error) {
+	n := m.Rows * m.Cols
+	if hostLittleEndian && n > 0 {
+		var b []byte
+		if m.Wide {
+			b = unsafe.Slice((*byte)(unsafe.Pointer(&m.Data64[0])), n*elemBytes64)
+		} else {
+			b = unsafe.Slice((*byte)(unsafe.Pointer(&m.Data[0])), n*elemBytes)
+		}
+		_, err := w.Write(b)
+		return uint64(len(b)), err
+	}
+	var buf bytes.Buffer
+	var b [elemBytes64]byte
+	for i := uint64(0); i < n; i++ {
+		if m.Wide {
+			binary.LittleEndian.PutUint64(b[:], uint64(m.Data64[i]))
+			buf.Write(b[:elemBytes64])
+		} else {
+			binary.LittleEndian.PutUint32(b[:], uint32(m.Data[i]))
+			buf.Write(b[:elemBytes])
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return uint64(buf.Len()), err
+}
+
+// hostLittleEndian reports whether the in-memory layout of matrix entries
+// matches the file format.
+var hostLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// OpenServer opens a server file written by Server.Save for scheme pi. The
+// matrices are memory-mapped where the platform supports it, and used in
+// place, so opening takes time independent of the database size, except for
+// expanding the shared state from its seed. The mapping is private: updates
+// made to the returned server stay in memory until it is saved again. Close
+// releases the mapping.
+func OpenServer(pi PIR, path string) (*Server, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mapFile(f, st.Size())
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseServerFile(pi, data)
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+	s.mapped = data
+	return s, nil
+}
+
+func parseServerFile(pi PIR, data []byte) (*Server, error) {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(serverFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != serverFileMagic {
+		return nil, fmt.Errorf("%w: not a server file", ErrMalformedMsg)
+	}
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil || n > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: truncated server file", ErrMalformedMsg)
+	}
+	s := &Server{pi: pi}
+	if err := s.params.UnmarshalBinary(data[len(data)-r.Len() : len(data)-r.Len()+int(n)]); err != nil {
+		return nil, err
+	}
+	r.Seek(int64(n), io.SeekCurrent)
+	if s.params.Scheme != pi.Name() {
+		return nil, fmt.Errorf("%w: server file is for %s, not %s", ErrInvalidParams, s.params.Scheme, pi.Name())
+	}
+
+	var counts [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &counts); err != nil {
+		return nil, fmt.Errorf("%w: truncated server file", ErrMalformedMsg)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &s.size); err != nil {
+		return nil, fmt.Errorf("%w: truncated server file", ErrMalformedMsg)
+	}
+	numHint, numLevels := uint64(counts[0]), uint64(counts[1])
+	if numLevels == 0 || (numHint+numLevels)*matrixEntryHdr > uint64(r.Len()) {
+		return nil, fmt.Errorf("%w: server file lists %d hint matrices and %d levels", ErrMalformedMsg, numHint, numLevels)
+	}
+	levels := make([]*ServerDB, numLevels)
+	for i := range levels {
+		levels[i] = new(ServerDB)
+		if err := binary.Read(r, binary.LittleEndian, &levels[i].info); err != nil {
+			return nil, fmt.Errorf("%w: truncated database info", ErrMalformedMsg)
+		}
+	}
+
+	mats := make([]*Matrix, numHint+numLevels)
+	for i := range mats {
+		var e [4]uint64
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			return nil, fmt.Errorf("%w: truncated matrix table", ErrMalformedMsg)
+		}
+		m, err := viewMatrix(data, e[0], e[1], e[2], e[3])
+		if err != nil {
+			return nil, err
+		}
+		mats[i] = m
+	}
+
+	s.hint = MakeMsg(mats[:numHint]...)
+	for i, db := range levels {
+		db.data = mats[numHint+uint64(i)]
+		if i+1 < len(levels) {
+			db.hint = levels[i+1]
+		}
+	}
+	s.db = levels[0]
+	if s.db.info != s.params.Info {
+		return nil, fmt.Errorf("%w: database info does not match public parameters", ErrMalformedMsg)
+	}
+	if s.size > s.params.Info.Num {
+		return nil, fmt.Errorf("%w: %d of %d records in use", ErrMalformedMsg, s.size, s.params.Info.Num)
+	}
+	s.shared = pi.DecompressState(s.params.Info, s.params.Params, MakeCompressedState(&s.params.Seed))
+	return s, nil
+}
+
+// viewMatrix returns the rows-by-cols matrix whose entries of width bytes
+// start at offset off of data. It aliases data if the layout allows it and
+// copies the entries otherwise.
+func viewMatrix(data []byte, rows, cols, width, off uint64) (*Matrix, error) {
+	if width != elemBytes && width != elemBytes64 {
+		return nil, fmt.Errorf("%w: unsupported entry width of %d bytes", ErrMalformedMsg, width)
+	}
+	// Bound the header fields before computing with them, so that a crafted
+	// file cannot wrap the length check below.
+	if cols == 0 || math.MaxUint64/cols/width < shardAlign || rows > math.MaxUint64/cols/width-shardAlign {
+		return nil, fmt.Errorf("%w: %d-by-%d matrix of %d-byte entries", ErrMalformedMsg, rows, cols, width)
+	}
+	size := uint64(len(data))
+	if off > size || rows+shardAlign > (size-off)/width/cols {
+		return nil, fmt.Errorf("%w: %d-by-%d matrix at offset %d exceeds the file", ErrMalformedMsg, rows, cols, off)
+	}
+	n := rows * cols
+	m := MatrixNewNoAlloc(rows, cols)
+	m.Wide = width == elemBytes64
+	b := data[off : off+n*width]
+
+	// Either way, the room for the kernels past the last row is kept as
+	// capacity; the file reserves it after every matrix.
+	pad := shardAlign * cols
+	if hostLittleEndian && off%width == 0 && n > 0 {
+		if m.Wide {
+			m.Data64 = unsafe.Slice((*C.Elem64)(unsafe.Pointer(&b[0])), n+pad)[:n]
+		} else {
+			m.Data = unsafe.Slice((*C.Elem)(unsafe.Pointer(&b[0])), n+pad)[:n]
+		}
+		return m, nil
+	}
+	if m.Wide {
+		m.Data64 = make([]C.Elem64, n+pad)[:n]
+		for i := range m.Data64 {
+			m.Data64[i] = C.Elem64(binary.LittleEndian.Uint64(b[i*elemBytes64:]))
+		}
+	} else {
+		m.Data = make([]C.Elem, n+pad)[:n]
+		for i := range m.Data {
+			m.Data[i] = C.Elem(binary.LittleEndian.Uint32(b[i*elemBytes:]))
+		}
+	}
+	return m, nil
+}
+
+// Close releases the file mapping of a server opened by OpenServer. The
+// server must not be used afterwards. It is a no-op for other servers.
+func (s *Server) Close() error {
+	if s.mapped == nil {
+		return nil
+	}
+	err := unmapFile(s.mapped)
+	s.mapped = nil
+	return err
+}
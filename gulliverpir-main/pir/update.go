@@ -0,0 +1,137 @@
+package pir
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// HintPatch describes how the hint changes when a database entry is updated.
+// Since H = DB·A is linear in DB, changing the Z_p elements in column Col by
+// Deltas[k] at rows Rows[k] adds Deltas[k]·A[Col,:] to row Rows[k] of H.
+// Patches commute, so they may be applied in any order, but each exactly
+// once.
+type HintPatch struct {
+	Col    uint64
+	Rows   []uint64
+	Deltas []uint64 // differences of the Z_p elements, wrapped modulo 2^64
+}
+
+// Apply adds the patch to the hint, using the public matrix A of the shared
+// state.
+func (h *HintPatch) Apply(hint Msg, shared State) error {
+	if err := checkMsg(hint.Data, 1, "hint"); err != nil {
+		return err
+	}
+	if err := checkMsg(shared.Data, 1, "shared state"); err != nil {
+		return err
+	}
+	H, A := hint.Data[0], shared.Data[0]
+	if H.Cols != A.Cols || h.Col >= A.Rows || len(h.Rows) != len(h.Deltas) {
+		return fmt.Errorf("%w: patch does not match hint and shared state", ErrMalformedMsg)
+	}
+	for _, r := range h.Rows {
+		if r >= H.Rows {
+			return fmt.Errorf("%w: patch row %d of %d", ErrMalformedMsg, r, H.Rows)
+		}
+	}
+	for k, r := range h.Rows {
+		for j := uint64(0); j < H.Cols; j++ {
+			H.Set(H.Get(r, j)+h.Deltas[k]*A.Get(h.Col, j), r, j)
+		}
+	}
+	return nil
+}
+
+// Update sets entry index of the database to value, in place, and returns
+// the patch that brings the hint up to date. It may run concurrently with
+// Answer. Databases with a second-level hint, as built by DoublePIR, cannot
+// be updated.
+func (s *ServerDB) Update(index, value uint64) (HintPatch, error) {
+	if s.info.Row_length < 64 && value >= 1<<s.info.Row_length {
+		return HintPatch{}, fmt.Errorf("%w: value %d does not fit in %d bits", ErrInvalidParams, value, s.info.Row_length)
+	}
+	if s.info.Packing > 0 {
+		return s.update(index, func(old []uint64) {
+			shift := (index % s.info.Packing) * s.info.Row_length
+			mask := uint64(1)<<s.info.Row_length - 1
+			old[0] = old[0]&^(mask<<shift) | value<<shift
+		})
+	}
+	return s.update(index, func(digits []uint64) {
+		for j := range digits {
+			digits[j] = Base_p(s.info.P, value, uint64(j))
+		}
+	})
+}
+
+// UpdateBytes is like Update for databases built by NewDatabaseFromBytes.
+func (s *ServerDB) UpdateBytes(index uint64, rec []byte) (HintPatch, error) {
+	if uint64(len(rec)) != (s.info.Row_length+7)/8 {
+		return HintPatch{}, fmt.Errorf("%w: record has %d bytes, expected %d",
+			ErrInvalidParams, len(rec), (s.info.Row_length+7)/8)
+	}
+	if s.info.Packing > 0 {
+		var v uint64
+		for _, b := range rec {
+			v = v<<8 | uint64(b)
+		}
+		return s.Update(index, v)
+	}
+	if new(big.Int).SetBytes(rec).BitLen() > int(s.info.Row_length) {
+		return HintPatch{}, fmt.Errorf("%w: record does not fit in %d bits", ErrInvalidParams, s.info.Row_length)
+	}
+	return s.update(index, func(digits []uint64) {
+		copy(digits, bytesToBaseP(rec, s.info.P, s.info.Ne))
+	})
+}
+
+// update reads the Z_p elements of entry index, lets set overwrite them and
+// writes them back, returning the patch for the difference.
+func (s *ServerDB) update(index uint64, set func(elems []uint64)) (HintPatch, error) {
+	if s.hint != nil {
+		return HintPatch{}, fmt.Errorf("%w: databases with a second-level hint cannot be updated", ErrInvalidParams)
+	}
+	if index >= s.info.Num {
+		return HintPatch{}, fmt.Errorf("%w: entry %d of %d", ErrIndexOutOfRange, index, s.info.Num)
+	}
+	row, col := s.info.entryPosition(index, s.info.Cols)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elems := make([]uint64, s.info.Ne)
+	for j := range elems {
+		elems[j] = s.getElem(row*s.info.Ne+uint64(j), col)
+	}
+	old := append([]uint64(nil), elems...)
+	set(elems)
+
+	patch := HintPatch{Col: col}
+	for j := range elems {
+		if elems[j] == old[j] {
+			continue
+		}
+		r := row*s.info.Ne + uint64(j)
+		s.setElem(elems[j], r, col)
+		patch.Rows = append(patch.Rows, r)
+		patch.Deltas = append(patch.Deltas, elems[j]-old[j])
+	}
+	return patch, nil
+}
+
+// getElem returns the Z_p element at row i and column j of the unsquished
+// database, in [0, p).
+func (s *ServerDB) getElem(i, j uint64) uint64 {
+	mask := uint64(1)<<s.info.Basis - 1
+	word := s.data.Get(i, j/s.info.Squishing)
+	return word >> ((j % s.info.Squishing) * s.info.Basis) & mask
+}
+
+// setElem sets the Z_p element at row i and column j of the unsquished
+// database to v in [0, p).
+func (s *ServerDB) setElem(v, i, j uint64) {
+	shift := (j % s.info.Squishing) * s.info.Basis
+	mask := (uint64(1)<<s.info.Basis - 1) << shift
+	word := s.data.Get(i, j/s.info.Squishing)
+	s.data.Set(word&^mask|v<<shift, i, j/s.info.Squishing)
+}
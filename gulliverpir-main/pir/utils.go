@@ -1,7 +1,6 @@
 package pir
 
 import (
-	"fmt"
 	"math"
 )
 
@@ -9,10 +8,16 @@ type State struct {
 	Data []*Matrix
 }
 
+// CompressedState is the seed from which the shared state can be rebuilt.
 type CompressedState struct {
 	Seed *PRGKey
 }
 
+// Size returns the number of bytes needed to transmit the compressed state.
+func (c *CompressedState) Size() uint64 {
+	return uint64(len(c.Seed))
+}
+
 type Msg struct {
 	Data []*Matrix
 }
@@ -98,7 +103,7 @@ func Num_DB_entries(N, rowLength, p uint64) (dbEntries, numElemsPerDBEntry, entr
 		dbEntries = uint64(math.Ceil(float64(N) / float64(entriesPerZpElem)))
 
 		if dbEntries == 0 || dbEntries > N {
-			fmt.Printf("Calculated number of entries is incorrect: %d for N = %d\n", dbEntries, N)
+			logf("Calculated number of entries is incorrect: %d for N = %d\n", dbEntries, N)
 			panic("Invalid number of database entries")
 		}
 
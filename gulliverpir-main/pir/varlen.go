@@ -0,0 +1,228 @@
+package pir
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// Variable-length records are stored in slots, fixed-width byte records of
+// SlotLen bytes each. A record is framed as its length (a big-endian uint32)
+// followed by its bytes, padded with zeros to a whole number of slots, and
+// stored in that many consecutive slots. The layout maps records to their
+// slots and is public; clients fetch MaxSlots slots per record, so that the
+// server does not learn how long the fetched record is.
+
+// varLenPrefix is the size of the length prefix of a framed record.
+const varLenPrefix = 4
+
+// VarLayout describes how variable-length records are spread over slots.
+type VarLayout struct {
+	SlotLen  uint64   // bytes per slot, the bucket size records are padded to
+	MaxSlots uint64   // most slots a record may span; 1 disables spreading
+	First    []uint64 // record i spans slots First[i], ..., First[i+1]-1
+}
+
+// NewVarLayout returns an empty layout with slots of slotLen bytes, for
+// records of up to maxSlots slots each.
+func NewVarLayout(slotLen, maxSlots uint64) (*VarLayout, error) {
+	if slotLen == 0 || maxSlots == 0 || slotLen*maxSlots < varLenPrefix {
+		return nil, fmt.Errorf("%w: slots of %d bytes, at most %d per record", ErrInvalidParams, slotLen, maxSlots)
+	}
+	return &VarLayout{SlotLen: slotLen, MaxSlots: maxSlots, First: []uint64{0}}, nil
+}
+
+// NumRecords returns the number of records in the layout.
+func (l *VarLayout) NumRecords() uint64 {
+	return uint64(len(l.First)) - 1
+}
+
+// NumSlots returns the number of slots in the layout, i.e. the number of
+// entries of the database that holds them.
+func (l *VarLayout) NumSlots() uint64 {
+	return l.First[len(l.First)-1]
+}
+
+// MaxRecordLen returns the length of the longest record that fits.
+func (l *VarLayout) MaxRecordLen() uint64 {
+	return l.SlotLen*l.MaxSlots - varLenPrefix
+}
+
+// Frame appends a record to the layout and returns the slots that hold it,
+// to be added to the database in order.
+func (l *VarLayout) Frame(rec []byte) ([][]byte, error) {
+	if uint64(len(rec)) > l.MaxRecordLen() || uint64(len(rec)) > 1<<32-1 {
+		return nil, fmt.Errorf("%w: record %d has %d bytes, at most %d fit",
+			ErrInvalidParams, l.NumRecords(), len(rec), l.MaxRecordLen())
+	}
+	framed := uint64(len(rec)) + varLenPrefix
+	n := (framed + l.SlotLen - 1) / l.SlotLen
+	buf := make([]byte, n*l.SlotLen)
+	binary.BigEndian.PutUint32(buf, uint32(len(rec)))
+	copy(buf[varLenPrefix:], rec)
+
+	slots := make([][]byte, n)
+	for k := range slots {
+		slots[k] = buf[uint64(k)*l.SlotLen : uint64(k+1)*l.SlotLen]
+	}
+	l.First = append(l.First, l.NumSlots()+n)
+	return slots, nil
+}
+
+// Slots returns the range of slots that hold record i.
+func (l *VarLayout) Slots(i uint64) (first, count uint64, err error) {
+	if i >= l.NumRecords() {
+		return 0, 0, fmt.Errorf("%w: record %d of %d", ErrIndexOutOfRange, i, l.NumRecords())
+	}
+	return l.First[i], l.First[i+1] - l.First[i], nil
+}
+
+// NewVarDatabase frames the records into slots and builds a database of
+// them. p must have room for layout.NumSlots() slots of SlotLen bytes; use
+// VarSlots to find out how many there will be.
+func NewVarDatabase(slotLen, maxSlots uint64, p *Params, records [][]byte) (*Database, *VarLayout, error) {
+	num, err := VarSlots(slotLen, maxSlots, records)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, _ := NewVarLayout(slotLen, maxSlots)
+	b, err := NewDBBuilder(num, 8*slotLen, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, rec := range records {
+		slots, err := l.Frame(rec)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, slot := range slots {
+			if err := b.AddBytes(slot); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	DB, err := b.Finish()
+	if err != nil {
+		return nil, nil, err
+	}
+	return DB, l, nil
+}
+
+// VarSlots returns the number of slots the records take in a layout with
+// slots of slotLen bytes.
+func VarSlots(slotLen, maxSlots uint64, records [][]byte) (uint64, error) {
+	l, err := NewVarLayout(slotLen, maxSlots)
+	if err != nil {
+		return 0, err
+	}
+	var num uint64
+	for i, rec := range records {
+		if uint64(len(rec)) > l.MaxRecordLen() {
+			return 0, fmt.Errorf("%w: record %d has %d bytes, at most %d fit",
+				ErrInvalidParams, i, len(rec), l.MaxRecordLen())
+		}
+		num += (uint64(len(rec)) + varLenPrefix + slotLen - 1) / slotLen
+	}
+	return num, nil
+}
+
+// Unframe returns the record framed in the given slots, in order, without
+// its length prefix and padding. It fails if the slots are inconsistent.
+func (l *VarLayout) Unframe(slots [][]byte) ([]byte, error) {
+	var buf []byte
+	for _, slot := range slots {
+		buf = append(buf, slot...)
+	}
+	if len(buf) < varLenPrefix {
+		return nil, fmt.Errorf("%w: framed record has %d bytes", ErrMalformedRecords, len(buf))
+	}
+	n := uint64(binary.BigEndian.Uint32(buf))
+	if n > uint64(len(buf)-varLenPrefix) {
+		return nil, fmt.Errorf("%w: length prefix %d exceeds the %d bytes of the slots",
+			ErrMalformedRecords, n, len(buf)-varLenPrefix)
+	}
+	return buf[varLenPrefix : varLenPrefix+n], nil
+}
+
+// FetchVar retrieves variable-length record i of a database laid out by l.
+// It always issues MaxSlots queries, for the slots of the record followed
+// by random ones, and answers each with answer, which typically sends the
+// query to the server.
+func (c *Client) FetchVar(l *VarLayout, i uint64, answer func(query []byte) ([]byte, error)) ([]byte, error) {
+	first, count, err := l.Slots(i)
+	if err != nil {
+		return nil, err
+	}
+	if count > l.MaxSlots || l.NumSlots() > c.NumRecords() {
+		return nil, fmt.Errorf("%w: layout does not match the database", ErrInvalidParams)
+	}
+
+	var slots [][]byte
+	for k := uint64(0); k < l.MaxSlots; k++ {
+		index := first + k
+		if k >= count {
+			index = RandInt(new(big.Int).SetUint64(l.NumSlots())).Uint64()
+		}
+		h, q, err := c.Query(index)
+		if err != nil {
+			return nil, err
+		}
+		ans, err := answer(q)
+		if err != nil {
+			c.Cancel(h)
+			return nil, err
+		}
+		slot, err := c.RecoverBytes(h, ans)
+		if err != nil {
+			return nil, err
+		}
+		if k < count {
+			slots = append(slots, slot)
+		}
+	}
+	return l.Unframe(slots)
+}
+
+const varLayoutMagic = "GPIRVL01"
+
+// MarshalBinary encodes the layout: the slot length, the maximum number of
+// slots per record and the number of records (uint64 each), then the first
+// slot of every record and the total number of slots.
+func (l *VarLayout) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, len(varLayoutMagic)+8*(3+len(l.First)))
+	copy(buf, varLayoutMagic)
+	off := len(varLayoutMagic)
+	for _, v := range append([]uint64{l.SlotLen, l.MaxSlots, l.NumRecords()}, l.First...) {
+		binary.LittleEndian.PutUint64(buf[off:], v)
+		off += 8
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a layout encoded by MarshalBinary.
+func (l *VarLayout) UnmarshalBinary(data []byte) error {
+	hdr := len(varLayoutMagic) + 24
+	if len(data) < hdr || string(data[:len(varLayoutMagic)]) != varLayoutMagic {
+		return fmt.Errorf("%w: not an encoding of a layout", ErrMalformedMsg)
+	}
+	get := func(k int) uint64 { return binary.LittleEndian.Uint64(data[len(varLayoutMagic)+8*k:]) }
+	num := get(2)
+	if num >= uint64(len(data)) || uint64(len(data)-hdr) != 8*(num+1) {
+		return fmt.Errorf("%w: layout of %d records has %d bytes", ErrMalformedMsg, num, len(data))
+	}
+	out := VarLayout{SlotLen: get(0), MaxSlots: get(1), First: make([]uint64, num+1)}
+	if out.SlotLen == 0 || out.MaxSlots == 0 || out.SlotLen*out.MaxSlots < varLenPrefix {
+		return fmt.Errorf("%w: layout has empty slots", ErrMalformedMsg)
+	}
+	for k := range out.First {
+		out.First[k] = get(3 + k)
+		if k > 0 && (out.First[k] <= out.First[k-1] || out.First[k]-out.First[k-1] > out.MaxSlots) {
+			return fmt.Errorf("%w: record %d spans slots %d to %d", ErrMalformedMsg, k-1, out.First[k-1], out.First[k])
+		}
+	}
+	if out.First[0] != 0 {
+		return fmt.Errorf("%w: layout does not start at slot 0", ErrMalformedMsg)
+	}
+	*l = out
+	return nil
+}